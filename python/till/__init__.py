@@ -50,6 +50,21 @@ class TillServer(object):
         r.raise_for_status()
         return (r.raw, r.headers.get("X-Till-Metadata", None))
 
+    def delete(self, key, providers=None):
+        """Delete a file from the Till server."""
+
+        headers = {}
+
+        if providers is not None:
+            headers["X-Till-Providers"] = ",".join(providers)
+
+        r = requests.delete(
+            self.__gen_url(key),
+            headers=headers,
+            timeout=self.timeout
+        )
+        r.raise_for_status()
+
 if __name__ == "__main__":
     t = TillServer("localhost:12345")
     for x in xrange(0, 1000):
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ *  Authentication for the HTTP API. Clients present either a static bearer
+ *  token or an HMAC-SHA256 signature of the request, and each token or key
+ *  grants some set of scopes. Other Till servers sign their requests with the
+ *  shared cluster secret. If no client credentials are configured, every
+ *  client request is allowed, as before; the cluster secret on its own only
+ *  protects the endpoints servers use to talk to each other.
+ *
+ *  Signed requests carry these headers:
+ *
+ *      X-Till-Timestamp: <unix time>
+ *      X-Till-Nonce: <random string>
+ *      X-Till-Content-SHA256: <hex SHA-256 of the body>
+ *      Authorization: TILL-HMAC-SHA256 <key id>:<hex signature>
+ *
+ *  where the signature is taken over the method, the request URI and then
+ *  every X-Till-* header as "<lowercase name>:<value>", sorted by name, all
+ *  separated by newlines. The body is checked against its digest as it's
+ *  read, and a signature is only accepted once. Cluster requests are signed
+ *  the same way with the cluster secret, and use
+ *  "Authorization: TILL-CLUSTER <hex signature>".
+ */
+
+const (
+	ScopeRead    = "read"
+	ScopeWrite   = "write"
+	ScopeAdmin   = "admin"
+	ScopeCluster = "cluster"
+)
+
+// Signed requests older (or newer) than this are rejected, to limit replays.
+const AuthMaxClockSkew = 5 * time.Minute
+
+var ErrNoCredentials = errors.New("This request requires credentials.")
+var ErrBadCredentials = errors.New("The credentials given are not valid.")
+var ErrBadTimestamp = errors.New("X-Till-Timestamp header is missing or too far from the current time.")
+var ErrBadNonce = errors.New("X-Till-Nonce header is missing.")
+var ErrBadContentDigest = errors.New("X-Till-Content-SHA256 header is missing or not a hex-encoded SHA-256 digest.")
+var ErrReplayedSignature = errors.New("This signature has already been used.")
+var ErrContentDigestMismatch = errors.New("The request body does not match its X-Till-Content-SHA256 header.")
+
+const (
+	AuthTimestampHeader = "X-Till-Timestamp"
+	AuthNonceHeader     = "X-Till-Nonce"
+	AuthContentHeader   = "X-Till-Content-SHA256"
+)
+
+// The digest signed for requests without a body.
+const EmptyContentDigest = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+var contentDigestPattern = regexp.MustCompile("^[0-9a-f]{64}$")
+
+type AuthToken struct {
+	Token  string   `json:"token"`
+	Scopes []string `json:"scopes"`
+}
+
+type AuthHMACKey struct {
+	Identifier string   `json:"id"`
+	Secret     string   `json:"secret"`
+	Scopes     []string `json:"scopes"`
+}
+
+type AuthConfig struct {
+	Tokens        []AuthToken   `json:"tokens"`
+	HMACKeys      []AuthHMACKey `json:"hmac_keys"`
+	ClusterSecret string        `json:"cluster_secret"`
+}
+
+// A ScopeFunc returns the scope a request needs.
+type ScopeFunc func(r *http.Request) string
+
+func IsValidClientScope(scope string) bool {
+	return scope == ScopeRead || scope == ScopeWrite || scope == ScopeAdmin
+}
+
+func validScopes(scopes []string) bool {
+	if len(scopes) == 0 {
+		return false
+	}
+	for _, scope := range scopes {
+		if !IsValidClientScope(scope) {
+			return false
+		}
+	}
+	return true
+}
+
+// Validate returns a copy of the config without any credentials that are
+// incomplete or ask for unknown scopes.
+func (a AuthConfig) Validate() *AuthConfig {
+	valid := &AuthConfig{ClusterSecret: a.ClusterSecret}
+
+	for i, token := range a.Tokens {
+		if len(token.Token) == 0 || !validScopes(token.Scopes) {
+			log.Printf("Ignoring auth token %d: token must be non-empty and scopes must be a list of \"read\", \"write\" or \"admin\".", i)
+		} else {
+			valid.Tokens = append(valid.Tokens, token)
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, key := range a.HMACKeys {
+		if len(key.Identifier) == 0 || len(key.Secret) == 0 || !validScopes(key.Scopes) {
+			log.Printf("Ignoring HMAC key \"%v\": id and secret must be non-empty and scopes must be a list of \"read\", \"write\" or \"admin\".", key.Identifier)
+		} else if seen[key.Identifier] {
+			log.Printf("Ignoring HMAC key \"%v\": id is used more than once.", key.Identifier)
+		} else {
+			seen[key.Identifier] = true
+			valid.HMACKeys = append(valid.HMACKeys, key)
+		}
+	}
+
+	return valid
+}
+
+// Enabled returns whether requests needing scope must be authenticated.
+// Client credentials protect every endpoint, but the cluster secret alone
+// only protects those that need the cluster scope.
+func (a *AuthConfig) Enabled(scope string) bool {
+	if a == nil {
+		return false
+	}
+	if len(a.Tokens) > 0 || len(a.HMACKeys) > 0 {
+		return true
+	}
+	return scope == ScopeCluster && len(a.ClusterSecret) > 0
+}
+
+// Authenticate checks a request's credentials, and returns the scopes they
+// grant.
+func (a *AuthConfig) Authenticate(r *http.Request) ([]string, error) {
+	header := r.Header.Get("Authorization")
+	if len(header) == 0 {
+		return nil, ErrNoCredentials
+	}
+
+	parts := strings.SplitN(header, " ", 2)
+	if len(parts) != 2 {
+		return nil, ErrBadCredentials
+	}
+	scheme, credentials := parts[0], strings.TrimSpace(parts[1])
+
+	switch scheme {
+	case "Bearer":
+		for _, token := range a.Tokens {
+			if subtle.ConstantTimeCompare([]byte(token.Token), []byte(credentials)) == 1 {
+				return token.Scopes, nil
+			}
+		}
+
+	case "TILL-HMAC-SHA256":
+		pair := strings.SplitN(credentials, ":", 2)
+		if len(pair) != 2 {
+			return nil, ErrBadCredentials
+		}
+		for _, key := range a.HMACKeys {
+			if key.Identifier == pair[0] {
+				if err := checkSignature(r, key.Secret, pair[1]); err != nil {
+					return nil, err
+				}
+				return key.Scopes, nil
+			}
+		}
+
+	case "TILL-CLUSTER":
+		if len(a.ClusterSecret) > 0 {
+			if err := checkSignature(r, a.ClusterSecret, credentials); err != nil {
+				return nil, err
+			}
+			return []string{ScopeRead, ScopeWrite, ScopeCluster}, nil
+		}
+	}
+
+	return nil, ErrBadCredentials
+}
+
+func signRequest(r *http.Request, secret string) string {
+	names := make([]string, 0, len(r.Header))
+	for name := range r.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-till-") {
+			names = append(names, lower)
+		}
+	}
+	sort.Strings(names)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(r.Method + "\n" + r.URL.RequestURI()))
+	for _, name := range names {
+		mac.Write([]byte("\n" + name + ":" + strings.Join(r.Header[http.CanonicalHeaderKey(name)], ",")))
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func checkSignature(r *http.Request, secret string, signature string) error {
+	t, err := strconv.ParseInt(r.Header.Get(AuthTimestampHeader), 10, 64)
+	if err != nil || math.Abs(float64(time.Now().Unix()-t)) > AuthMaxClockSkew.Seconds() {
+		return ErrBadTimestamp
+	}
+	if len(r.Header.Get(AuthNonceHeader)) == 0 {
+		return ErrBadNonce
+	}
+	digest := r.Header.Get(AuthContentHeader)
+	if !contentDigestPattern.MatchString(digest) {
+		return ErrBadContentDigest
+	}
+
+	signature = strings.ToLower(signature)
+	expected := signRequest(r, secret)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return ErrBadCredentials
+	}
+
+	//	The timestamp check already rejects the signature once it's out of
+	//	the window, so it only needs remembering until then.
+	if !authReplays.Check(signature, t+int64(AuthMaxClockSkew.Seconds())) {
+		return ErrReplayedSignature
+	}
+
+	if r.Body != nil {
+		r.Body = &digestReader{ReadCloser: r.Body, hash: sha256.New(), expected: digest}
+	}
+	return nil
+}
+
+// A digestReader fails the final read of a request body that doesn't match
+// the digest it was signed with.
+type digestReader struct {
+	io.ReadCloser
+
+	hash     hash.Hash
+	expected string
+}
+
+func (d *digestReader) Read(buf []byte) (int, error) {
+	length, err := d.ReadCloser.Read(buf)
+	d.hash.Write(buf[0:length])
+	if err == io.EOF && hex.EncodeToString(d.hash.Sum(nil)) != d.expected {
+		return length, ErrContentDigestMismatch
+	}
+	return length, err
+}
+
+// A replayCache remembers the signatures it has accepted until they expire.
+type replayCache struct {
+	mutex  sync.Mutex
+	seen   map[string]int64
+	pruned int64
+}
+
+var authReplays = &replayCache{seen: make(map[string]int64)}
+
+// Check records signature until expires, and returns false if it has been
+// seen before.
+func (c *replayCache) Check(signature string, expires int64) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now().Unix()
+	if now-c.pruned >= 60 {
+		for seen, until := range c.seen {
+			if until < now {
+				delete(c.seen, seen)
+			}
+		}
+		c.pruned = now
+	}
+
+	if until, exists := c.seen[signature]; exists && until >= now {
+		return false
+	}
+	c.seen[signature] = expires
+	return true
+}
+
+// SignClusterRequest signs an outgoing request to another Till server with
+// the cluster secret, if there is one. It must be called after every other
+// X-Till-* header has been set.
+func SignClusterRequest(req *http.Request) {
+	auth := state.Config.Auth
+	if auth == nil || len(auth.ClusterSecret) == 0 {
+		return
+	}
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		log.Printf("Could not generate a nonce for a cluster request: %v", err)
+		return
+	}
+
+	digest := EmptyContentDigest
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err == nil {
+			h := sha256.New()
+			_, err = io.Copy(h, body)
+			body.Close()
+			digest = hex.EncodeToString(h.Sum(nil))
+		}
+		if err != nil {
+			log.Printf("Could not read the body of a cluster request: %v", err)
+			return
+		}
+	}
+
+	req.Header.Set(AuthTimestampHeader, strconv.FormatInt(time.Now().Unix(), 10))
+	req.Header.Set(AuthNonceHeader, hex.EncodeToString(nonce))
+	req.Header.Set(AuthContentHeader, digest)
+	req.Header.Set("Authorization", "TILL-CLUSTER "+signRequest(req, auth.ClusterSecret))
+}
+
+func RequireScope(scope string) ScopeFunc {
+	return func(r *http.Request) string {
+		return scope
+	}
+}
+
+// ObjectScope requires the read scope to fetch objects, and the write scope
+// to change them.
+func ObjectScope(r *http.Request) string {
+	if r.Method == "GET" || r.Method == "HEAD" {
+		return ScopeRead
+	}
+	return ScopeWrite
+}
+
+// Authorized wraps a handler so that it's only called for requests with
+// credentials for the scope it needs.
+func Authorized(scope ScopeFunc, handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(writer http.ResponseWriter, r *http.Request) {
+		auth := state.Config.Auth
+		needed := scope(r)
+		if !auth.Enabled(needed) {
+			handler(writer, r)
+			return
+		}
+
+		scopes, err := auth.Authenticate(r)
+		if err != nil {
+			writer.Header().Set("WWW-Authenticate", "Bearer realm=\"tilld\"")
+			http.Error(writer, "\""+err.Error()+"\"", 401)
+			return
+		}
+
+		for _, s := range scopes {
+			if s == needed {
+				handler(writer, r)
+				return
+			}
+		}
+		http.Error(writer, "\"These credentials do not grant the "+needed+" scope.\"", 403)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+ *  Read-through backfill: when a provider with a promote_to list answers a
+ *  GET, the response is also written to a temporary file. Once the whole
+ *  object has been sent to the client, it's copied from that file into the
+ *  promote_to providers in the background.
+ */
+
+type BackfillWriter struct {
+	http.ResponseWriter
+
+	file    *os.File
+	status  int
+	written int64
+	failed  bool
+}
+
+func NewBackfillWriter(writer http.ResponseWriter) *BackfillWriter {
+	file, err := ioutil.TempFile("", "tilld-backfill-")
+	if err != nil {
+		log.Printf("Could not create temporary file for backfill: %v", err)
+		return nil
+	}
+
+	return &BackfillWriter{
+		ResponseWriter: writer,
+		file:           file,
+	}
+}
+
+func (w *BackfillWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *BackfillWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = 200
+	}
+
+	length, err := w.ResponseWriter.Write(data)
+	if w.status == 200 && !w.failed {
+		if _, ferr := w.file.Write(data[0:length]); ferr != nil {
+			log.Printf("Could not write backfill data: %v", ferr)
+			w.failed = true
+		}
+		w.written += int64(length)
+	}
+	return length, err
+}
+
+// Finish starts the backfill if the complete object was sent to the
+// client, and throws the temporary file away otherwise.
+func (w *BackfillWriter) Finish(ctx context.Context, bo BaseObject, size int64, targets []Provider) {
+	if w.status != 200 || w.failed || w.written != size {
+		w.file.Close()
+		os.Remove(w.file.Name())
+		return
+	}
+
+	go Backfill(DetachedContext(ctx), bo, w.file, size, targets)
+}
+
+func Backfill(ctx context.Context, bo BaseObject, file *os.File, size int64, targets []Provider) {
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	//	Keep whatever is left of the object's lifespan, if it's known.
+	now := time.Now()
+	if bo.Expires <= 0 {
+		bo.Expires = now.Add(time.Duration(GetDefaultLifespan(bo.identifier)) * time.Second).Unix()
+	} else if bo.Expires <= now.Unix() {
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, p := range targets {
+		if !p.Breaker().Allow() {
+			LogFor(ctx).Infof("Not backfilling object %v into %v: its circuit is open.", bo.identifier, p)
+			continue
+		}
+
+		wg.Add(1)
+		go func(p Provider) {
+			defer wg.Done()
+
+			ctx, span := StartProviderSpan(ctx, p, OpPut, bo.identifier)
+			span.SetAttribute("till.backfill", true)
+			started := time.Now()
+			o, err, timedOut := CallProvider(ctx, p, OpPut, func(ctx context.Context) (Object, error) {
+				obj := UploadObject{
+					BaseObject: bo,
+					reader:     ioutil.NopCloser(io.NewSectionReader(file, 0, size)),
+					size:       size,
+				}
+				defer obj.Close()
+				return p.Put(ctx, &obj)
+			})
+			if timedOut {
+				p.Counters().RecordTimeout(OpPut)
+			} else {
+				p.Counters().RecordWrite(OpPut, started, err)
+			}
+			RecordCircuit(ctx, p, err, timedOut)
+			span.End(err)
+			if o != nil {
+				o.Close()
+			}
+			if err != nil {
+				LogFor(ctx).Errorf("Could not backfill object %v into %v: %v", bo.identifier, p, err)
+			} else {
+				p.Counters().RecordBytes(OpPut, size)
+				LogFor(ctx).Infof("Backfilled object %v into %v.", bo.identifier, p)
+			}
+		}(p)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+ *  Circuit breakers. Once a provider has failed (or timed out) some number of
+ *  requests in a row, its circuit opens, and requests skip it rather than
+ *  waiting on it. When its backoff has passed, one request is let through as
+ *  a probe: if that succeeds the circuit closes again, and if not it stays
+ *  open for twice as long, up to a maximum.
+ */
+
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half_open"
+
+	DefaultCircuitFailures   = 5
+	DefaultCircuitBackoff    = 1 * time.Second
+	DefaultCircuitMaxBackoff = 60 * time.Second
+)
+
+type CircuitBreakerConfig struct {
+	//  Consecutive failures that open the circuit; 0 never opens it.
+	Failures   int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+type CircuitBreaker struct {
+	config CircuitBreakerConfig
+
+	mutex    sync.Mutex
+	failures int
+	opened   int64
+	backoff  time.Duration
+	retryAt  time.Time
+	probing  bool
+}
+
+type CircuitStats struct {
+	State               string `json:"state"`
+	ConsecutiveFailures int    `json:"consecutive_failures"`
+	Opened              int64  `json:"opened"`
+
+	//  When the next probe will be let through, if the circuit is open.
+	RetryAt int64 `json:"retry_at,omitempty"`
+}
+
+func NewCircuitBreaker(config CircuitBreakerConfig) *CircuitBreaker {
+	return &CircuitBreaker{config: config}
+}
+
+// Must be called with the mutex held.
+func (b *CircuitBreaker) tripped() bool {
+	return b.config.Failures > 0 && b.failures >= b.config.Failures
+}
+
+// Allow returns whether a request should be made to the provider. While the
+// circuit is half-open, one request is allowed through per backoff period.
+func (b *CircuitBreaker) Allow() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if !b.tripped() {
+		return true
+	}
+
+	now := time.Now()
+	if now.Before(b.retryAt) {
+		return false
+	}
+
+	//  If the probe never reports back (it might be cancelled, say), another
+	//  is let through once the backoff has passed again.
+	b.probing = true
+	b.retryAt = now.Add(b.backoff)
+	return true
+}
+
+func (b *CircuitBreaker) Success() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.failures = 0
+	b.backoff = 0
+	b.probing = false
+}
+
+func (b *CircuitBreaker) Failure() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	wasTripped := b.tripped()
+	b.failures++
+
+	if !wasTripped && b.tripped() {
+		b.opened++
+		b.backoff = b.config.Backoff
+		b.retryAt = time.Now().Add(b.backoff)
+	} else if wasTripped && b.probing {
+		//  Requests already under way when the circuit opened don't count
+		//  against it; only a failed probe does.
+		b.backoff *= 2
+		if b.backoff > b.config.MaxBackoff {
+			b.backoff = b.config.MaxBackoff
+		}
+		b.retryAt = time.Now().Add(b.backoff)
+	}
+	b.probing = false
+}
+
+func (b *CircuitBreaker) Stats() CircuitStats {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	stats := CircuitStats{
+		State:               CircuitClosed,
+		ConsecutiveFailures: b.failures,
+		Opened:              b.opened,
+	}
+	if b.tripped() {
+		if time.Now().Before(b.retryAt) && !b.probing {
+			stats.State = CircuitOpen
+			stats.RetryAt = b.retryAt.Unix()
+		} else {
+			stats.State = CircuitHalfOpen
+		}
+	}
+	return stats
+}
+
+// ForJSON describes a request that skipped the provider because its circuit
+// was open, for the per-provider error map.
+func (b *CircuitBreaker) ForJSON() map[string]string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	retry := time.Until(b.retryAt) / time.Millisecond
+	if retry < 0 {
+		retry = 0
+	}
+	return map[string]string{
+		"status":      "CIRCUIT_OPEN",
+		"failures":    strconv.Itoa(b.failures),
+		"retry_in_ms": strconv.FormatInt(int64(retry), 10),
+	}
+}
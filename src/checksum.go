@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var ErrChecksumMismatch = errors.New("Object does not match its checksum.")
+var ErrKeyNotDigest = errors.New("Object identifier must be the SHA-256 of the object's contents.")
+var ErrDigestMismatch = errors.New("Object does not match the SHA-256 in its identifier.")
+
+var sha256HexPattern = regexp.MustCompile("^[0-9a-fA-F]{64}$")
+
+/*
+ *  ChecksumObject wraps an object that's being served, computing the SHA-256
+ *  of its contents as they're read. Reading the whole object from the start
+ *  verifies it against its stored checksum; the final byte is held back
+ *  until that check passes, so a corrupt object is never sent in full.
+ */
+
+type ChecksumObject struct {
+	Object
+
+	expected string
+	size     int64
+
+	hash      hash.Hash
+	read      int64
+	pending   []byte
+	scratch   []byte
+	done      bool
+	verifying bool
+	err       error
+}
+
+// A SeekableChecksumObject only verifies reads that start at offset 0 and
+// continue, without seeking, to the end of the object.
+type SeekableChecksumObject struct {
+	*ChecksumObject
+}
+
+func NewChecksumObject(o Object, expected string, size int64) *ChecksumObject {
+	return &ChecksumObject{
+		Object:    o,
+		expected:  expected,
+		size:      size,
+		hash:      sha256.New(),
+		verifying: true,
+	}
+}
+
+// Err returns ErrChecksumMismatch if the object was found to be corrupt.
+func (c *ChecksumObject) Err() error {
+	return c.err
+}
+
+func (c *ChecksumObject) Read(buf []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	//  Keep at least one byte more than can be returned, until the end.
+	for !c.done && len(c.pending) <= len(buf) {
+		if len(c.scratch) < len(buf) {
+			c.scratch = make([]byte, len(buf))
+		}
+
+		length, err := c.Object.Read(c.scratch[0:len(buf)])
+		if length > 0 {
+			c.hash.Write(c.scratch[0:length])
+			c.pending = append(c.pending, c.scratch[0:length]...)
+			c.read += int64(length)
+		}
+
+		if err == io.EOF || (c.size >= 0 && c.read >= c.size) {
+			c.done = true
+			if c.verifying && hex.EncodeToString(c.hash.Sum(nil)) != c.expected {
+				c.err = ErrChecksumMismatch
+				return 0, c.err
+			}
+		} else if err != nil {
+			return 0, err
+		} else if length == 0 {
+			break
+		}
+	}
+
+	available := len(c.pending)
+	if !c.done && available > 0 {
+		available--
+	}
+
+	length := copy(buf, c.pending[0:available])
+	c.pending = c.pending[length:]
+	if c.done && len(c.pending) == 0 {
+		return length, io.EOF
+	}
+	return length, nil
+}
+
+func (c *SeekableChecksumObject) Seek(offset int64, whence int) (int64, error) {
+	seekable := c.Object.(SeekableObject)
+
+	if whence == 1 {
+		//  The underlying object is ahead by whatever's been held back.
+		offset -= int64(len(c.pending))
+	}
+
+	position, err := seekable.Seek(offset, whence)
+	if err != nil {
+		return position, err
+	}
+
+	c.pending = c.pending[0:0]
+	c.done = false
+	if position == 0 {
+		c.hash.Reset()
+		c.read = 0
+		c.verifying = true
+	} else {
+		c.read = position
+		c.verifying = false
+	}
+	return position, nil
+}
+
+// IsContentAddressed returns true if an object with this id must be stored
+// under its own SHA-256, either because the id matches one of the
+// content_addressed_patterns or because one of the providers is configured
+// with content_addressed.
+func IsContentAddressed(id string, providers []Provider) bool {
+	for _, pattern := range state.Config.ContentAddressedPatterns {
+		if pattern.MatchString(id) {
+			return true
+		}
+	}
+	for _, p := range providers {
+		if p.ContentAddressed() {
+			return true
+		}
+	}
+	return false
+}
+
+// SpoolContentAddressed copies src into a temporary file, hashing it as it
+// goes, and checks the result against id. On success the file is returned
+// rewound to its start; the caller is responsible for closing and removing it.
+func SpoolContentAddressed(id string, src io.Reader, maxSize int64) (*os.File, error) {
+	if !sha256HexPattern.MatchString(id) {
+		return nil, ErrKeyNotDigest
+	}
+
+	file, err := ioutil.TempFile("", "tilld-upload-")
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.New()
+	if maxSize > 0 {
+		//  Read one byte more than allowed, to tell if there was more.
+		src = io.LimitReader(src, maxSize+1)
+	}
+	written, err := io.Copy(io.MultiWriter(file, hash), src)
+	if err == nil && maxSize > 0 && written > maxSize {
+		err = ErrObjectTooLarge
+	}
+	if err == nil && !strings.EqualFold(hex.EncodeToString(hash.Sum(nil)), id) {
+		err = ErrDigestMismatch
+	}
+	if err == nil {
+		_, err = file.Seek(0, 0)
+	}
+
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return file, nil
+}
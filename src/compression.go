@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/*
+ *  Providers may compress the objects they store. A compressed object's
+ *  BaseObject records its Encoding (as used in Content-Encoding) and its
+ *  DecodedSize; each provider stores these along with the object's other
+ *  metadata. Objects are decompressed as they're served, unless the client
+ *  accepts their encoding, in which case they're sent as stored.
+ */
+
+// Objects smaller than this are stored uncompressed, unless the provider's
+// compression_min_size says otherwise.
+const DefaultCompressionMinSize = 1024
+
+var ErrUnknownEncoding = errors.New("Object has an unknown encoding.")
+
+func IsValidCompression(compression string) bool {
+	return compression == "gzip" || compression == "zstd" || compression == "none"
+}
+
+func NewEncoder(encoding string, w io.Writer) (io.WriteCloser, error) {
+	switch encoding {
+	case "gzip":
+		return gzip.NewWriter(w), nil
+	case "zstd":
+		encoder, err := zstd.NewWriter(w)
+		if err != nil {
+			return nil, err
+		}
+		return encoder, nil
+	default:
+		return nil, ErrUnknownEncoding
+	}
+}
+
+func NewDecoder(encoding string, r io.Reader) (io.ReadCloser, error) {
+	switch encoding {
+	case "gzip":
+		return gzip.NewReader(r)
+	case "zstd":
+		decoder, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	default:
+		return nil, ErrUnknownEncoding
+	}
+}
+
+// FormatEncoding returns the encoding and decoded size of an object as a
+// single string, for providers that store them in one field.
+func FormatEncoding(bo BaseObject) string {
+	if len(bo.Encoding) == 0 {
+		return ""
+	}
+	return bo.Encoding + ":" + strconv.FormatInt(bo.DecodedSize, 10)
+}
+
+// ParseEncoding reads a string written by FormatEncoding into bo.
+func ParseEncoding(s string, bo *BaseObject) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) == 2 {
+		size, err := strconv.ParseInt(parts[1], 10, 64)
+		if err == nil {
+			bo.Encoding = parts[0]
+			bo.DecodedSize = size
+		}
+	}
+}
+
+// DiscardStoredETag clears an ETag read from a backend that digests the bytes
+// it stores, if those bytes were compressed or encrypted: it isn't the ETag
+// of the object itself. Call it once the encoding and metadata are read.
+func DiscardStoredETag(bo *BaseObject) {
+	if len(bo.Encoding) > 0 || IsEncrypted(*bo) {
+		bo.ETag = ""
+	}
+}
+
+// AcceptsEncoding returns true if an Accept-Encoding header allows encoding.
+func AcceptsEncoding(header string, encoding string) bool {
+	for _, accepted := range strings.Split(header, ",") {
+		params := strings.Split(accepted, ";")
+		if strings.TrimSpace(params[0]) != encoding {
+			continue
+		}
+
+		//  "gzip;q=0" means the client refuses gzip.
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				if err == nil && q == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// EncodedETag returns the ETag of an object sent in its stored encoding,
+// which differs from that of the decoded object.
+func EncodedETag(etag string, encoding string) string {
+	if len(etag) == 0 || len(encoding) == 0 {
+		return etag
+	}
+	return etag + "-" + encoding
+}
+
+/*
+ *  EncodedObject is what a provider stores in place of the object passed to
+ *  Put. It's either the object itself, or a compressed copy of it. The copy
+ *  is either compressed as it's read, or spooled to a temporary file first
+ *  for providers that need to know its size before storing it.
+ */
+
+type EncodedObject struct {
+	BaseObject
+
+	source Object
+	reader io.Reader
+	file   *os.File
+	size   int64
+
+	//  Set when compressing as the object is read; DecodedSize is only
+	//  known once the pipe has been read to the end.
+	pipe *io.PipeReader
+}
+
+// CompressObject compresses o with encoding, unless it's smaller than
+// minSize, encoding is "none", or it's already compressed. If spool is set,
+// o is read and compressed in full before CompressObject returns.
+func CompressObject(o Object, encoding string, minSize int64, spool bool) (Object, error) {
+	encoded := &EncodedObject{source: o, reader: o}
+
+	//  Don't wait for a chunked upload to be read in full just to find out
+	//  how large it is.
+	size, err := ContentLength(o)
+	if err != nil {
+		return nil, err
+	}
+	if encoding == "" || encoding == "none" || len(o.GetBaseObject().Encoding) > 0 || (size >= 0 && size < minSize) {
+		encoded.size = size
+		return encoded, nil
+	}
+
+	//  Objects of unknown size are only compressed once they're known to
+	//  be at least minSize.
+	head, err := ioutil.ReadAll(io.LimitReader(o, minSize))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(head)) < minSize {
+		encoded.reader = bytes.NewReader(head)
+		encoded.size = int64(len(head))
+		return encoded, nil
+	}
+	source := io.MultiReader(bytes.NewReader(head), o)
+
+	if !spool {
+		reader, writer := io.Pipe()
+		encoded.Encoding = encoding
+		encoded.reader = reader
+		encoded.pipe = reader
+		encoded.size = -1
+		go func() {
+			encoder, err := NewEncoder(encoding, writer)
+			var decodedSize int64
+			if err == nil {
+				decodedSize, err = io.Copy(encoder, source)
+			}
+			if err == nil {
+				err = encoder.Close()
+			}
+			encoded.DecodedSize = decodedSize
+			writer.CloseWithError(err)
+		}()
+		return encoded, nil
+	}
+
+	file, err := ioutil.TempFile("", "tilld-compress-")
+	if err != nil {
+		return nil, err
+	}
+
+	encoder, err := NewEncoder(encoding, file)
+	var decodedSize int64
+	if err == nil {
+		decodedSize, err = io.Copy(encoder, source)
+	}
+	if err == nil {
+		err = encoder.Close()
+	}
+	var compressedSize int64
+	if err == nil {
+		compressedSize, err = file.Seek(0, 1)
+	}
+	if err == nil {
+		_, err = file.Seek(0, 0)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+
+	encoded.Encoding = encoding
+	encoded.DecodedSize = decodedSize
+	encoded.reader = file
+	encoded.file = file
+	encoded.size = compressedSize
+	return encoded, nil
+}
+
+func (e *EncodedObject) GetBaseObject() BaseObject {
+	bo := e.source.GetBaseObject()
+	if len(e.Encoding) > 0 {
+		bo.Encoding = e.Encoding
+		bo.DecodedSize = e.DecodedSize
+	}
+	return bo
+}
+
+// GetSize returns -1 for an object that's compressed as it's read.
+func (e *EncodedObject) GetSize() (int64, error) {
+	if e.pipe != nil {
+		return -1, nil
+	} else if e.size < 0 {
+		return e.source.GetSize()
+	}
+	return e.size, nil
+}
+
+func (e *EncodedObject) Read(buf []byte) (int, error) {
+	return e.reader.Read(buf)
+}
+
+// Close removes any temporary file, or stops compressing, but leaves the
+// source object open.
+func (e *EncodedObject) Close() error {
+	if e.pipe != nil {
+		return e.pipe.Close()
+	}
+	if e.file == nil {
+		return nil
+	}
+	e.file.Close()
+	err := os.Remove(e.file.Name())
+	e.file = nil
+	return err
+}
+
+/*
+ *  DecodedObject decompresses an object as it's read.
+ */
+
+type DecodedObject struct {
+	Object
+
+	decoder io.ReadCloser
+}
+
+// DecodeObject returns an object that reads o decompressed, or o itself if
+// it isn't compressed. Closing a decoded object doesn't close o.
+func DecodeObject(o Object) (Object, error) {
+	bo := o.GetBaseObject()
+	if len(bo.Encoding) == 0 {
+		return o, nil
+	}
+
+	decoder, err := NewDecoder(bo.Encoding, o)
+	if err != nil {
+		return nil, err
+	}
+	return &DecodedObject{Object: o, decoder: decoder}, nil
+}
+
+func (d *DecodedObject) GetBaseObject() BaseObject {
+	bo := d.Object.GetBaseObject()
+	bo.Encoding = ""
+	bo.DecodedSize = 0
+	return bo
+}
+
+func (d *DecodedObject) GetSize() (int64, error) {
+	return d.Object.GetBaseObject().DecodedSize, nil
+}
+
+func (d *DecodedObject) Read(buf []byte) (int, error) {
+	return d.decoder.Read(buf)
+}
+
+func (d *DecodedObject) Close() error {
+	return d.decoder.Close()
+}
+
+// Compress returns o compressed as configured, compressing it as it's read.
+func (b *BaseProvider) Compress(o Object) (Object, error) {
+	return CompressObject(o, b.config.Compression(), b.config.CompressionMinSize(), false)
+}
+
+// CompressSized is Compress for providers that need to know the size of
+// what they store, and its metadata, before storing it.
+func (b *BaseProvider) CompressSized(o Object) (Object, error) {
+	return CompressObject(o, b.config.Compression(), b.config.CompressionMinSize(), true)
+}
@@ -2,9 +2,11 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"log"
 	"regexp"
+	"time"
 )
 
 type ProviderConfig interface {
@@ -12,12 +14,39 @@ type ProviderConfig interface {
 	Type() string
 	NewProvider() (Provider, error)
 	AcceptsKey(key string) bool
+	PromoteTo() []string
+	ContentAddressed() bool
+	Compression() string
+	CompressionMinSize() int64
+	EncryptionKeys() []*EncryptionKey
+	Tier() string
+	HedgeDelay() time.Duration
+	Timeout(operation string) time.Duration
+	CircuitBreaker() CircuitBreakerConfig
 }
 
 type BaseProviderConfig struct {
-	kind      string           `json:"type"`
-	name      string           `json:"name"`
-	whitelist []*regexp.Regexp `json:"whitelist"`
+	kind             string           `json:"type"`
+	name             string           `json:"name"`
+	whitelist        []*regexp.Regexp `json:"whitelist"`
+	promoteTo        []string         `json:"promote_to"`
+	contentAddressed bool             `json:"content_addressed"`
+
+	compression        string `json:"compression"`
+	compressionMinSize int64  `json:"compression_min_size"`
+
+	encryptionKeys []*EncryptionKey `json:"-"`
+
+	tier       string        `json:"tier"`
+	hedgeDelay time.Duration `json:"hedge_delay_in_milliseconds"`
+
+	//  0 if the provider has no limit of its own.
+	getTimeout    time.Duration `json:"get_timeout_in_milliseconds"`
+	putTimeout    time.Duration `json:"put_timeout_in_milliseconds"`
+	updateTimeout time.Duration `json:"update_timeout_in_milliseconds"`
+	deleteTimeout time.Duration `json:"delete_timeout_in_milliseconds"`
+
+	circuitBreaker CircuitBreakerConfig `json:"-"`
 }
 
 func (c BaseProviderConfig) Name() string {
@@ -37,10 +66,87 @@ func (c BaseProviderConfig) AcceptsKey(key string) bool {
 	return false
 }
 
+func (c BaseProviderConfig) PromoteTo() []string {
+	return c.promoteTo
+}
+
+func (c BaseProviderConfig) ContentAddressed() bool {
+	return c.contentAddressed
+}
+
+func (c BaseProviderConfig) Compression() string {
+	return c.compression
+}
+
+func (c BaseProviderConfig) CompressionMinSize() int64 {
+	return c.compressionMinSize
+}
+
+func (c BaseProviderConfig) EncryptionKeys() []*EncryptionKey {
+	return c.encryptionKeys
+}
+
+func (c BaseProviderConfig) Tier() string {
+	return c.tier
+}
+
+func (c BaseProviderConfig) HedgeDelay() time.Duration {
+	return c.hedgeDelay
+}
+
+// Timeout returns how long a single request of the given operation may take,
+// or 0 if only the request-wide timeout applies.
+func (c BaseProviderConfig) Timeout(operation string) time.Duration {
+	switch operation {
+	case OpGet, OpStat, OpGetURL:
+		return c.getTimeout
+	case OpPut:
+		return c.putTimeout
+	case OpUpdate:
+		return c.updateTimeout
+	case OpDelete:
+		return c.deleteTimeout
+	}
+	return 0
+}
+
+func (c BaseProviderConfig) CircuitBreaker() CircuitBreakerConfig {
+	return c.circuitBreaker
+}
+
 func (c BaseProviderConfig) NewProvider() (Provider, error) {
 	return nil, nil
 }
 
+func GetStringList(data map[string]interface{}, key string) ([]string, error) {
+	list := make([]string, 0)
+	if src, exists := data[key]; exists {
+		if interfaces, ok := src.([]interface{}); ok {
+			for _, i := range interfaces {
+				if s, ok := i.(string); ok {
+					list = append(list, s)
+				} else {
+					return nil, errors.New(key + " must be a list of strings.")
+				}
+			}
+		} else {
+			return nil, errors.New(key + " must be a list of strings.")
+		}
+	}
+	return list, nil
+}
+
+func GetMilliseconds(data map[string]interface{}, key string, fallback time.Duration) (time.Duration, error) {
+	if src, exists := data[key]; exists {
+		if f, ok := src.(float64); ok && f >= 0 {
+			return time.Duration(f * float64(time.Millisecond)), nil
+		} else {
+			return fallback, errors.New(key + " must be a non-negative number.")
+		}
+	}
+	return fallback, nil
+}
+
 func NewProviderConfig(data map[string]interface{}) ProviderConfig {
 	kind := data["type"]
 
@@ -64,14 +170,123 @@ func NewProviderConfig(data map[string]interface{}) ProviderConfig {
 		}
 	}
 
+	promoteTo := make([]string, 0)
+	if src, exists := data["promote_to"]; exists {
+		if names, ok := src.([]interface{}); ok {
+			for _, obj := range names {
+				if name, ok := obj.(string); ok {
+					promoteTo = append(promoteTo, name)
+				} else {
+					log.Printf("Non-string promote_to entry found: %v", obj)
+				}
+			}
+		} else {
+			log.Printf("promote_to for provider %v is not a list.", data["name"])
+		}
+	}
+
+	contentAddressed := false
+	if src, exists := data["content_addressed"]; exists {
+		if b, ok := src.(bool); ok {
+			contentAddressed = b
+		} else {
+			log.Printf("content_addressed for provider %v is not a boolean.", data["name"])
+		}
+	}
+
+	compression := "none"
+	if src, exists := data["compression"]; exists {
+		if s, ok := src.(string); ok && IsValidCompression(s) {
+			compression = s
+		} else {
+			log.Printf("compression for provider %v must be \"gzip\", \"zstd\" or \"none\".", data["name"])
+			return nil
+		}
+	}
+
+	compressionMinSize := int64(DefaultCompressionMinSize)
+	if src, exists := data["compression_min_size"]; exists {
+		if f, ok := src.(float64); ok && f >= 0 {
+			compressionMinSize = int64(f)
+		} else {
+			log.Printf("compression_min_size for provider %v must be a non-negative number.", data["name"])
+			return nil
+		}
+	}
+
+	tier := ""
+	if src, exists := data["tier"]; exists {
+		if s, ok := src.(string); ok {
+			tier = s
+		} else {
+			log.Printf("tier for provider %v must be a string.", data["name"])
+			return nil
+		}
+	}
+
+	durations := make(map[string]time.Duration)
+	for key, fallback := range map[string]time.Duration{
+		"hedge_delay_in_milliseconds":                 -1,
+		"get_timeout_in_milliseconds":                 0,
+		"put_timeout_in_milliseconds":                 0,
+		"update_timeout_in_milliseconds":              0,
+		"delete_timeout_in_milliseconds":              0,
+		"circuit_breaker_backoff_in_milliseconds":     DefaultCircuitBackoff,
+		"circuit_breaker_max_backoff_in_milliseconds": DefaultCircuitMaxBackoff,
+	} {
+		d, err := GetMilliseconds(data, key, fallback)
+		if err != nil {
+			log.Printf("Could not configure provider %v: %v", data["name"], err)
+			return nil
+		}
+		durations[key] = d
+	}
+
+	circuitBreaker := CircuitBreakerConfig{
+		Failures:   DefaultCircuitFailures,
+		Backoff:    durations["circuit_breaker_backoff_in_milliseconds"],
+		MaxBackoff: durations["circuit_breaker_max_backoff_in_milliseconds"],
+	}
+	if src, exists := data["circuit_breaker_failures"]; exists {
+		if f, ok := src.(float64); ok && f >= 0 {
+			circuitBreaker.Failures = int(f)
+		} else {
+			log.Printf("circuit_breaker_failures for provider %v must be a non-negative number.", data["name"])
+			return nil
+		}
+	}
+	if circuitBreaker.Backoff <= 0 {
+		circuitBreaker.Backoff = DefaultCircuitBackoff
+	}
+	if circuitBreaker.MaxBackoff < circuitBreaker.Backoff {
+		circuitBreaker.MaxBackoff = circuitBreaker.Backoff
+	}
+
+	encryptionKeys, err := ParseEncryptionKeys(data)
+	if err != nil {
+		log.Printf("Could not read encryption keys for provider %v: %v", data["name"], err)
+		return nil
+	}
+
 	config := BaseProviderConfig{
-		kind:      data["type"].(string),
-		name:      data["name"].(string),
-		whitelist: whitelist,
+		kind:               data["type"].(string),
+		name:               data["name"].(string),
+		whitelist:          whitelist,
+		promoteTo:          promoteTo,
+		contentAddressed:   contentAddressed,
+		compression:        compression,
+		compressionMinSize: compressionMinSize,
+		encryptionKeys:     encryptionKeys,
+		tier:               tier,
+		hedgeDelay:         durations["hedge_delay_in_milliseconds"],
+		getTimeout:         durations["get_timeout_in_milliseconds"],
+		putTimeout:         durations["put_timeout_in_milliseconds"],
+		updateTimeout:      durations["update_timeout_in_milliseconds"],
+		deleteTimeout:      durations["delete_timeout_in_milliseconds"],
+		circuitBreaker:     circuitBreaker,
 	}
 
 	var output ProviderConfig
-	var err error
 
 	switch kind {
 	case "redis":
@@ -89,7 +304,7 @@ func NewProviderConfig(data map[string]interface{}) ProviderConfig {
 	}
 
 	if err != nil {
-		log.Printf("Could not parse provider from data %v\n%v", data, err)
+		log.Printf("Could not parse %v provider \"%v\": %v", data["type"], data["name"], err)
 		return nil
 	} else {
 		return output
@@ -97,19 +312,30 @@ func NewProviderConfig(data map[string]interface{}) ProviderConfig {
 }
 
 type BaseConfig struct {
-	Port                      int    `json:"port"`
-	Bind                      string `json:"bind"`
-	DefaultLifespan           int    `json:"default_lifespan"`
-	PublicAddress             string `json:"public_address"`
-	GetTimeoutInMilliseconds  int    `json:"get_timeout_in_milliseconds"`
-	PostTimeoutInMilliseconds int    `json:"post_timeout_in_milliseconds"`
+	Port                        int    `json:"port"`
+	Bind                        string `json:"bind"`
+	DefaultLifespan             int    `json:"default_lifespan"`
+	PublicAddress               string `json:"public_address"`
+	GetTimeoutInMilliseconds    int    `json:"get_timeout_in_milliseconds"`
+	PostTimeoutInMilliseconds   int    `json:"post_timeout_in_milliseconds"`
+	UpdateTimeoutInMilliseconds int    `json:"update_timeout_in_milliseconds"`
+	DeleteTimeoutInMilliseconds int    `json:"delete_timeout_in_milliseconds"`
+	DefaultURLLifespan          int    `json:"default_url_lifespan"`
+	MaxObjectSize               int64  `json:"max_object_size"`
+	UploadBufferSize            int    `json:"upload_buffer_size"`
+	LogLevel                    string `json:"log_level"`
+	ReadStrategy                string `json:"read_strategy"`
+	HedgeDelayInMilliseconds    int    `json:"hedge_delay_in_milliseconds"`
 }
 
 type IncomingConfig struct {
 	BaseConfig
 
-	Providers        []interface{}      `json:"providers"`
-	LifespanPatterns map[string]float64 `json:"lifespan_patterns"`
+	Providers                []interface{}      `json:"providers"`
+	LifespanPatterns         map[string]float64 `json:"lifespan_patterns"`
+	ContentAddressedPatterns []string           `json:"content_addressed_patterns"`
+	Auth                     AuthConfig         `json:"auth"`
+	Tracing                  TracingConfig      `json:"tracing"`
 }
 
 func (c *IncomingConfig) toConfig() *Config {
@@ -135,6 +361,16 @@ func (c *IncomingConfig) toConfig() *Config {
 		}
 	}
 
+	contentAddressedPatterns := make([]*regexp.Regexp, 0, len(c.ContentAddressedPatterns))
+	for _, pattern := range c.ContentAddressedPatterns {
+		p, err := regexp.Compile(pattern)
+		if err != nil {
+			log.Printf("Invalid regexp \"%v\" in content_addressed_patterns: %v", pattern, err)
+		} else {
+			contentAddressedPatterns = append(contentAddressedPatterns, p)
+		}
+	}
+
 	config := &Config{}
 	//	TODO: Not this
 	config.Port = c.Port
@@ -142,7 +378,10 @@ func (c *IncomingConfig) toConfig() *Config {
 	config.Providers = newProviders
 	config.DefaultLifespan = c.DefaultLifespan
 	config.LifespanPatterns = lifespanPatterns
+	config.ContentAddressedPatterns = contentAddressedPatterns
 	config.PublicAddress = c.PublicAddress
+	config.Auth = c.Auth.Validate()
+	config.Tracing = c.Tracing.Validate()
 
 	if c.GetTimeoutInMilliseconds > 0 {
 		config.GetTimeoutInMilliseconds = c.GetTimeoutInMilliseconds
@@ -154,6 +393,48 @@ func (c *IncomingConfig) toConfig() *Config {
 	} else {
 		config.PostTimeoutInMilliseconds = 1000
 	}
+	if c.UpdateTimeoutInMilliseconds > 0 {
+		config.UpdateTimeoutInMilliseconds = c.UpdateTimeoutInMilliseconds
+	} else {
+		config.UpdateTimeoutInMilliseconds = 1000
+	}
+	if c.DeleteTimeoutInMilliseconds > 0 {
+		config.DeleteTimeoutInMilliseconds = c.DeleteTimeoutInMilliseconds
+	} else {
+		config.DeleteTimeoutInMilliseconds = 1000
+	}
+	if c.DefaultURLLifespan > 0 {
+		config.DefaultURLLifespan = c.DefaultURLLifespan
+	} else {
+		config.DefaultURLLifespan = 3600
+	}
+	config.MaxObjectSize = c.MaxObjectSize
+	if _, ok := ParseLogLevel(c.LogLevel); ok {
+		config.LogLevel = c.LogLevel
+	} else {
+		if len(c.LogLevel) > 0 {
+			log.Printf("log_level must be one of \"debug\", \"info\", \"warn\" or \"error\"; using \"info\".")
+		}
+		config.LogLevel = "info"
+	}
+	if IsValidReadStrategy(c.ReadStrategy) {
+		config.ReadStrategy = c.ReadStrategy
+	} else {
+		if len(c.ReadStrategy) > 0 {
+			log.Printf("read_strategy must be one of \"race\", \"sequential\" or \"hedged\"; using \"race\".")
+		}
+		config.ReadStrategy = ReadRace
+	}
+	if c.HedgeDelayInMilliseconds > 0 {
+		config.HedgeDelayInMilliseconds = c.HedgeDelayInMilliseconds
+	} else {
+		config.HedgeDelayInMilliseconds = DefaultHedgeDelay
+	}
+	if c.UploadBufferSize > 0 {
+		config.UploadBufferSize = c.UploadBufferSize
+	} else {
+		config.UploadBufferSize = 4 * 1024 * 1024
+	}
 
 	return config
 }
@@ -161,8 +442,11 @@ func (c *IncomingConfig) toConfig() *Config {
 type Config struct {
 	BaseConfig
 
-	Providers        []ProviderConfig           `json:"providers"`
-	LifespanPatterns map[*regexp.Regexp]float64 `json:"lifespan_patterns"`
+	Providers                []ProviderConfig           `json:"providers"`
+	LifespanPatterns         map[*regexp.Regexp]float64 `json:"lifespan_patterns"`
+	ContentAddressedPatterns []*regexp.Regexp           `json:"content_addressed_patterns"`
+	Auth                     *AuthConfig                `json:"-"`
+	Tracing                  *TracingConfig             `json:"-"`
 }
 
 func NewConfigFromJSONFile(configfile string) (*Config, error) {
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Demote copies an object that source is evicting for capacity into each
+// of targets, keeping its metadata and remaining lifespan. A fresh copy of
+// the object is opened for every target. The source keeps serving the
+// object while it's copied, and should only remove it if Demote succeeds;
+// otherwise Demote returns the first error. As the copies outlive the request
+// that caused the eviction, ctx should come from DetachedContext.
+func Demote(ctx context.Context, bo BaseObject, source Provider, open func() (Object, error), targets []Provider) error {
+	if bo.Expires > 0 && bo.Expires <= time.Now().Unix() {
+		//	Already expired; nothing worth keeping.
+		return nil
+	}
+
+	var result error
+	for _, p := range targets {
+		if !p.Breaker().Allow() {
+			LogFor(ctx).Infof("Could not demote object %v from %v to %v: its circuit is open.", bo.identifier, source, p)
+			if result == nil {
+				result = errors.New("The circuit of " + p.Name() + " is open.")
+			}
+			continue
+		}
+
+		o, err := open()
+		if err != nil {
+			return err
+		}
+
+		size, err := o.GetSize()
+		if err != nil {
+			o.Close()
+			return err
+		}
+
+		ctx, span := StartProviderSpan(ctx, p, OpPut, bo.identifier)
+		span.SetAttribute("till.demotion", true)
+		started := time.Now()
+		put, err, timedOut := CallProvider(ctx, p, OpPut, func(ctx context.Context) (Object, error) {
+			//	The opened object's metadata may differ from bo's if the
+			//	source stores it encrypted.
+			obj := UploadObject{
+				BaseObject: o.GetBaseObject(),
+				reader:     o,
+				size:       size,
+			}
+			defer obj.Close()
+			return p.Put(ctx, &obj)
+		})
+		if timedOut {
+			p.Counters().RecordTimeout(OpPut)
+		} else {
+			p.Counters().RecordWrite(OpPut, started, err)
+		}
+		RecordCircuit(ctx, p, err, timedOut)
+		span.End(err)
+		if put != nil {
+			put.Close()
+		}
+
+		if err != nil {
+			LogFor(ctx).Errorf("Could not demote object %v from %v to %v: %v", bo.identifier, source, p, err)
+			if result == nil {
+				result = err
+			}
+		} else {
+			p.Counters().RecordBytes(OpPut, size)
+			LogFor(ctx).Infof("Demoted object %v from %v to %v.", bo.identifier, source, p)
+		}
+	}
+	return result
+}
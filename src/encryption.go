@@ -0,0 +1,523 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync/atomic"
+)
+
+/*
+ *  Providers may encrypt the objects they store, using envelope encryption:
+ *  every object gets its own random data key, which is stored alongside it
+ *  wrapped (with AES-GCM) by one of the provider's configured keys. Each of
+ *  those keys has an id that's stored with the wrapped data key, so that
+ *  keys can be rotated by adding a new one at the front of the list and
+ *  keeping the old ones until the objects they protect have expired.
+ *
+ *  The object itself is split into EncryptionChunkSize chunks, each sealed
+ *  with AES-GCM under the data key. A chunk's nonce is its index, plus a
+ *  flag that marks the final chunk, so that chunks can't be reordered or
+ *  the object truncated without detection. The object's identifier is
+ *  authenticated along with every chunk, so that objects can't be swapped.
+ *
+ *  The wrapped data key is stored in place of the object's metadata, along
+ *  with the metadata itself and the object's ETag, checksum and encoding,
+ *  sealed under the data key. Those all describe the plaintext, so they're
+ *  blanked on the object that's stored, and restored when it's decrypted;
+ *  providers need no changes to store them.
+ */
+
+const EncryptionChunkSize = 64 * 1024
+
+// The size of the authentication tag that AES-GCM adds to each chunk.
+const aesGCMOverhead = 16
+
+const EncryptedMetadataPrefix = "till-encrypted:"
+
+var ErrDecryptionFailed = errors.New("Object could not be decrypted.")
+var ErrUnknownEncryptionKey = errors.New("Object is encrypted with an unknown key.")
+
+// Clients can't store metadata that looks like an encryption envelope, as
+// it would make an unencrypted object look encrypted when it's read.
+var ErrReservedMetadata = errors.New("X-Till-Metadata header must not start with \"" + EncryptedMetadataPrefix + "\".")
+
+type EncryptionKey struct {
+	Identifier string `json:"id"`
+	Key        string `json:"key"`
+
+	aead cipher.AEAD
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// ParseEncryptionKeys reads the keys listed in encryption_keys, followed by
+// those in the JSON file named by encryption_key_file. The first key is the
+// one used to encrypt new objects.
+func ParseEncryptionKeys(data map[string]interface{}) ([]*EncryptionKey, error) {
+	keys := make([]*EncryptionKey, 0)
+
+	if src, exists := data["encryption_keys"]; exists {
+		encoded, err := json.Marshal(src)
+		if err == nil {
+			err = json.Unmarshal(encoded, &keys)
+		}
+		if err != nil {
+			return nil, errors.New("encryption_keys must be a list of objects with an id and a key.")
+		}
+	}
+
+	if src, exists := data["encryption_key_file"]; exists {
+		path, ok := src.(string)
+		if !ok {
+			return nil, errors.New("encryption_key_file must be a string.")
+		}
+
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		fileKeys := make([]*EncryptionKey, 0)
+		err = json.Unmarshal(contents, &fileKeys)
+		if err != nil {
+			return nil, fmt.Errorf("%v must be a list of objects with an id and a key.", path)
+		}
+		keys = append(keys, fileKeys...)
+	}
+
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		if len(key.Identifier) == 0 || strings.Contains(key.Identifier, ":") {
+			return nil, errors.New("Encryption key ids must be non-empty and contain no colons.")
+		} else if seen[key.Identifier] {
+			return nil, fmt.Errorf("Encryption key id \"%v\" is used more than once.", key.Identifier)
+		}
+		seen[key.Identifier] = true
+
+		raw, err := base64.StdEncoding.DecodeString(key.Key)
+		if err != nil || len(raw) != 32 {
+			return nil, fmt.Errorf("Encryption key \"%v\" must be 32 bytes, base64-encoded.", key.Identifier)
+		}
+
+		key.aead, err = newAEAD(raw)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+func IsEncrypted(bo BaseObject) bool {
+	return strings.HasPrefix(bo.Metadata, EncryptedMetadataPrefix)
+}
+
+// EncryptedSize returns the size of an object of plaintextSize once encrypted.
+func EncryptedSize(plaintextSize int64) int64 {
+	chunks := (plaintextSize + EncryptionChunkSize - 1) / EncryptionChunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	return plaintextSize + chunks*int64(aesGCMOverhead)
+}
+
+// DecryptedSize is the inverse of EncryptedSize.
+func DecryptedSize(encryptedSize int64) int64 {
+	chunks := (encryptedSize + EncryptionChunkSize + aesGCMOverhead - 1) / (EncryptionChunkSize + aesGCMOverhead)
+	return encryptedSize - chunks*int64(aesGCMOverhead)
+}
+
+// chunkNonce returns the nonce for a chunk: its index, and whether it's the
+// last chunk. Metadata is sealed with nonces that no chunk uses.
+func chunkNonce(index uint64, final bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, index)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// metadataNonce returns the nonce for the count'th sealing of an object's
+// attributes. They're sealed again whenever they're asked for, as the ETag
+// and checksum are only known once the object's been read.
+func metadataNonce(count uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, count)
+	nonce[11] = 2
+	return nonce
+}
+
+// The parts of a BaseObject that are sealed in the encryption envelope.
+type sealedAttributes struct {
+	Metadata    string `json:"metadata"`
+	ETag        string `json:"etag,omitempty"`
+	Checksum    string `json:"checksum,omitempty"`
+	Encoding    string `json:"encoding,omitempty"`
+	DecodedSize int64  `json:"decoded_size,omitempty"`
+}
+
+/*
+ *  EncryptedObject is what a provider stores in place of the object passed
+ *  to Put.
+ */
+
+type EncryptedObject struct {
+	BaseObject
+
+	source   Object
+	envelope string
+	seals    uint64
+	aead     cipher.AEAD
+	aad      []byte
+
+	plain   []byte
+	pending []byte
+	chunk   uint64
+	done    bool
+}
+
+// EncryptObject returns o encrypted with a new data key, wrapped by key.
+func EncryptObject(o Object, key *EncryptionKey) (Object, error) {
+	bo := o.GetBaseObject()
+	aad := []byte(bo.identifier)
+
+	dataKey := make([]byte, 32)
+	nonce := make([]byte, key.aead.NonceSize())
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	wrapped := key.aead.Seal(nonce, nonce, dataKey, aad)
+
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &EncryptedObject{
+		source: o,
+		envelope: EncryptedMetadataPrefix + key.Identifier +
+			":" + base64.StdEncoding.EncodeToString(wrapped),
+		aead:  aead,
+		aad:   aad,
+		plain: make([]byte, 0, EncryptionChunkSize+1),
+	}, nil
+}
+
+// GetBaseObject seals the source object's current attributes into its
+// metadata, and blanks them, so that providers store them encrypted.
+func (e *EncryptedObject) GetBaseObject() BaseObject {
+	bo := e.source.GetBaseObject()
+	attributes, _ := json.Marshal(sealedAttributes{
+		Metadata:    bo.Metadata,
+		ETag:        bo.ETag,
+		Checksum:    bo.Checksum,
+		Encoding:    bo.Encoding,
+		DecodedSize: bo.DecodedSize,
+	})
+	nonce := metadataNonce(atomic.AddUint64(&e.seals, 1))
+	sealed := e.aead.Seal(nonce, nonce, attributes, e.aad)
+
+	bo.Metadata = e.envelope + ":" + base64.StdEncoding.EncodeToString(sealed)
+	bo.ETag = ""
+	bo.Checksum = ""
+	bo.Encoding = ""
+	bo.DecodedSize = 0
+	return bo
+}
+
+func (e *EncryptedObject) GetSize() (int64, error) {
+	size, err := e.source.GetSize()
+	if err != nil || size < 0 {
+		return size, err
+	}
+	return EncryptedSize(size), nil
+}
+
+func (e *EncryptedObject) Read(buf []byte) (int, error) {
+	for len(e.pending) == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+
+		//  Read one byte past the end of the chunk, to tell if it's the last.
+		length, err := io.ReadFull(e.source, e.plain[len(e.plain):EncryptionChunkSize+1])
+		e.plain = e.plain[0 : len(e.plain)+length]
+
+		var chunk []byte
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			chunk = e.plain
+			e.done = true
+		} else if err != nil {
+			return 0, err
+		} else {
+			chunk = e.plain[0:EncryptionChunkSize]
+		}
+
+		e.pending = e.aead.Seal(nil, chunkNonce(e.chunk, e.done), chunk, e.aad)
+		e.chunk++
+		e.plain = e.plain[0:copy(e.plain, e.plain[len(chunk):])]
+	}
+
+	length := copy(buf, e.pending)
+	e.pending = e.pending[length:]
+	return length, nil
+}
+
+// Close does nothing; the source object is left open.
+func (e *EncryptedObject) Close() error {
+	return nil
+}
+
+/*
+ *  DecryptedObject decrypts a stored object as it's read.
+ */
+
+type DecryptedObject struct {
+	Object
+
+	bo   BaseObject
+	aead cipher.AEAD
+	aad  []byte
+
+	sealed   []byte
+	pending  []byte
+	chunk    uint64
+	done     bool
+	position int64
+	skip     int
+}
+
+// A SeekableDecryptedObject wraps a stored object that can itself seek.
+type SeekableDecryptedObject struct {
+	*DecryptedObject
+}
+
+// DecryptMetadata returns bo with its metadata, ETag, checksum and encoding
+// restored from its envelope, and the AEAD for its contents. Objects that
+// aren't encrypted are returned as they are, with a nil AEAD.
+func DecryptMetadata(bo BaseObject, keys []*EncryptionKey) (BaseObject, cipher.AEAD, error) {
+	if !IsEncrypted(bo) {
+		return bo, nil, nil
+	}
+
+	parts := strings.Split(strings.TrimPrefix(bo.Metadata, EncryptedMetadataPrefix), ":")
+	if len(parts) != 3 {
+		return bo, nil, ErrDecryptionFailed
+	}
+
+	var key *EncryptionKey
+	for _, k := range keys {
+		if k.Identifier == parts[0] {
+			key = k
+		}
+	}
+	if key == nil {
+		return bo, nil, ErrUnknownEncryptionKey
+	}
+
+	wrapped, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil || len(wrapped) < key.aead.NonceSize() {
+		return bo, nil, ErrDecryptionFailed
+	}
+	sealed, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return bo, nil, ErrDecryptionFailed
+	}
+
+	aad := []byte(bo.identifier)
+	nonceSize := key.aead.NonceSize()
+	dataKey, err := key.aead.Open(nil, wrapped[0:nonceSize], wrapped[nonceSize:], aad)
+	if err != nil {
+		return bo, nil, ErrDecryptionFailed
+	}
+
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return bo, nil, err
+	}
+
+	//  Objects stored before the envelope held anything but the metadata
+	//  have it sealed alone, with the first metadata nonce and no prefix.
+	if len(sealed) > nonceSize {
+		attributes, err := aead.Open(nil, sealed[0:nonceSize], sealed[nonceSize:], aad)
+		if err == nil {
+			var sa sealedAttributes
+			if json.Unmarshal(attributes, &sa) != nil {
+				return bo, nil, ErrDecryptionFailed
+			}
+			bo.Metadata = sa.Metadata
+			bo.ETag = sa.ETag
+			bo.Checksum = sa.Checksum
+			bo.Encoding = sa.Encoding
+			bo.DecodedSize = sa.DecodedSize
+			return bo, aead, nil
+		}
+	}
+
+	metadata, err := aead.Open(nil, metadataNonce(0), sealed, aad)
+	if err != nil {
+		return bo, nil, ErrDecryptionFailed
+	}
+
+	bo.Metadata = string(metadata)
+	return bo, aead, nil
+}
+
+// DecryptObject returns an object that reads o decrypted, or o itself if it
+// isn't encrypted. If o can't be decrypted, it's closed. Closing the result
+// closes o.
+func DecryptObject(o Object, keys []*EncryptionKey) (Object, error) {
+	if o == nil {
+		return nil, nil
+	}
+
+	bo, aead, err := DecryptMetadata(o.GetBaseObject(), keys)
+	if err != nil {
+		o.Close()
+		return nil, err
+	} else if aead == nil {
+		return o, nil
+	}
+
+	decrypted := &DecryptedObject{
+		Object: o,
+		bo:     bo,
+		aead:   aead,
+		aad:    []byte(bo.identifier),
+		sealed: make([]byte, EncryptionChunkSize+aesGCMOverhead),
+	}
+	if _, ok := o.(SeekableObject); ok {
+		return &SeekableDecryptedObject{decrypted}, nil
+	}
+	return decrypted, nil
+}
+
+func (d *DecryptedObject) GetBaseObject() BaseObject {
+	return d.bo
+}
+
+func (d *DecryptedObject) GetSize() (int64, error) {
+	size, err := d.Object.GetSize()
+	if err != nil || size < 0 {
+		return size, err
+	}
+	return DecryptedSize(size), nil
+}
+
+func (d *DecryptedObject) Read(buf []byte) (int, error) {
+	for len(d.pending) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+
+		length, err := io.ReadFull(d.Object, d.sealed)
+		if err == io.EOF {
+			//  The final chunk is missing.
+			return 0, ErrDecryptionFailed
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+
+		//  A full chunk may or may not be the last one; a short one must be.
+		sealed := d.sealed[0:length]
+		var plain []byte
+		opened := false
+		if err == nil {
+			plain, err = d.aead.Open(nil, chunkNonce(d.chunk, false), sealed, d.aad)
+			opened = err == nil
+		}
+		if !opened {
+			plain, err = d.aead.Open(nil, chunkNonce(d.chunk, true), sealed, d.aad)
+			if err != nil {
+				return 0, ErrDecryptionFailed
+			}
+			d.done = true
+		}
+		d.chunk++
+
+		if d.skip > len(plain) {
+			d.skip = len(plain)
+		}
+		d.pending = plain[d.skip:]
+		d.skip = 0
+	}
+
+	length := copy(buf, d.pending)
+	d.pending = d.pending[length:]
+	d.position += int64(length)
+	return length, nil
+}
+
+func (d *SeekableDecryptedObject) Seek(offset int64, whence int) (int64, error) {
+	var position int64
+	switch whence {
+	case 0:
+		position = offset
+	case 1:
+		position = d.position + offset
+	case 2:
+		size, err := d.GetSize()
+		if err != nil {
+			return d.position, err
+		} else if size < 0 {
+			return d.position, errors.New("Cannot seek from the end of an object of unknown size.")
+		}
+		position = size + offset
+	default:
+		return d.position, errors.New("Invalid whence.")
+	}
+
+	if position < 0 {
+		return d.position, errors.New("Cannot seek to a negative position.")
+	}
+
+	//  Seek to the start of the chunk holding position, and skip into it.
+	chunk := position / EncryptionChunkSize
+	_, err := d.Object.(SeekableObject).Seek(chunk*(EncryptionChunkSize+aesGCMOverhead), 0)
+	if err != nil {
+		return d.position, err
+	}
+
+	d.chunk = uint64(chunk)
+	d.skip = int(position % EncryptionChunkSize)
+	d.pending = nil
+	d.done = false
+	d.position = position
+	return position, nil
+}
+
+func (b *BaseProvider) Encrypts() bool {
+	return len(b.config.EncryptionKeys()) > 0
+}
+
+// Encrypt returns o encrypted with the provider's current key, if it has
+// any keys. The result doesn't need to be closed separately from o.
+func (b *BaseProvider) Encrypt(o Object) (Object, error) {
+	keys := b.config.EncryptionKeys()
+	if len(keys) == 0 {
+		return o, nil
+	}
+	return EncryptObject(o, keys[0])
+}
+
+func (b *BaseProvider) Decrypt(o Object) (Object, error) {
+	return DecryptObject(o, b.config.EncryptionKeys())
+}
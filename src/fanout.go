@@ -0,0 +1,321 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+)
+
+var ErrObjectTooLarge = errors.New("Object exceeds the maximum object size.")
+var ErrUploadAbandoned = errors.New("Upload was abandoned before it completed.")
+
+/*
+ *  FanOutWriter tees a single source (usually a request body) to any number
+ *  of FanOutReaders, each of which can be read at its own pace.
+ *
+ *  Data is held in memory until every reader has consumed it. If the buffer
+ *  fills up while some reader is waiting on new data (i.e.: another reader
+ *  is lagging behind), everything is spilled to a temporary file and all
+ *  further reads are served from disk.
+ */
+
+type FanOutWriter struct {
+	src        io.Reader
+	maxSize    int64
+	bufferSize int
+
+	mutex sync.Mutex
+	cond  *sync.Cond
+
+	//  In-memory data, starting at offset base into the stream.
+	buffer  []byte
+	base    int64
+	written int64
+
+	spill       *os.File
+	spillFailed bool
+
+	readers []*FanOutReader
+	waiting int
+
+	//  MD5 of everything read from the source, used as the object's ETag,
+	//  and SHA-256, used as its checksum.
+	hash     hash.Hash
+	checksum hash.Hash
+
+	//  io.EOF once the source has been fully read.
+	err error
+}
+
+type FanOutReader struct {
+	fanout *FanOutWriter
+	offset int64
+	closed bool
+}
+
+func NewFanOutWriter(src io.Reader, maxSize int64, bufferSize int) *FanOutWriter {
+	f := &FanOutWriter{
+		src:        src,
+		maxSize:    maxSize,
+		bufferSize: bufferSize,
+		buffer:     make([]byte, 0),
+		readers:    make([]*FanOutReader, 0),
+		hash:       md5.New(),
+		checksum:   sha256.New(),
+	}
+	f.cond = sync.NewCond(&f.mutex)
+	return f
+}
+
+// Reader must be called for every consumer before Start.
+func (f *FanOutWriter) Reader() *FanOutReader {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	r := &FanOutReader{fanout: f}
+	f.readers = append(f.readers, r)
+	return r
+}
+
+func (f *FanOutWriter) Start() {
+	go f.pump()
+}
+
+// Err returns nil while the source is still being read, io.EOF if it
+// was read completely, and the reason for stopping otherwise.
+func (f *FanOutWriter) Err() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.err
+}
+
+// Digest returns the hex-encoded MD5 of the source once it has been
+// read completely, or an empty string before then.
+func (f *FanOutWriter) Digest() string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.err == io.EOF {
+		return hex.EncodeToString(f.hash.Sum(nil))
+	} else {
+		return ""
+	}
+}
+
+// Checksum returns the hex-encoded SHA-256 of the source once it has been
+// read completely, or an empty string before then.
+func (f *FanOutWriter) Checksum() string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.err == io.EOF {
+		return hex.EncodeToString(f.checksum.Sum(nil))
+	} else {
+		return ""
+	}
+}
+
+// Close stops reading from the source. Readers can still consume whatever
+// has already been read, after which they receive ErrUploadAbandoned.
+func (f *FanOutWriter) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.err == nil {
+		f.err = ErrUploadAbandoned
+	}
+	f.cond.Broadcast()
+	f.cleanup()
+	return nil
+}
+
+func (f *FanOutWriter) pump() {
+	chunk := make([]byte, 32*1024)
+	for {
+		f.mutex.Lock()
+		for f.err == nil && f.spill == nil && len(f.buffer) >= f.bufferSize {
+			if f.waiting > 0 && !f.spillFailed {
+				f.spillToDisk()
+			} else {
+				f.cond.Wait()
+			}
+		}
+		if f.err == nil && f.openReaders() == 0 {
+			f.err = ErrUploadAbandoned
+		}
+		if f.err != nil {
+			f.cleanup()
+			f.mutex.Unlock()
+			return
+		}
+		f.mutex.Unlock()
+
+		length, err := f.src.Read(chunk)
+
+		f.mutex.Lock()
+		if f.err == nil {
+			if f.maxSize > 0 && f.written+int64(length) > f.maxSize {
+				f.err = ErrObjectTooLarge
+			} else if length > 0 {
+				if f.spill != nil {
+					if _, werr := f.spill.WriteAt(chunk[0:length], f.written); werr != nil {
+						log.Printf("Could not write upload to temporary file: %v", werr)
+						f.err = werr
+					}
+				} else {
+					f.buffer = append(f.buffer, chunk[0:length]...)
+				}
+				f.hash.Write(chunk[0:length])
+				f.checksum.Write(chunk[0:length])
+				f.written += int64(length)
+			}
+
+			if f.err == nil && err != nil {
+				f.err = err
+			}
+		}
+		f.cond.Broadcast()
+		f.mutex.Unlock()
+	}
+}
+
+// Must be called with the mutex held.
+func (f *FanOutWriter) spillToDisk() {
+	file, err := ioutil.TempFile("", "tilld-upload-")
+	if err != nil {
+		log.Printf("Could not create temporary file for upload: %v", err)
+		f.spillFailed = true
+		return
+	}
+
+	_, err = file.WriteAt(f.buffer, f.base)
+	if err != nil {
+		log.Printf("Could not write upload to temporary file: %v", err)
+		file.Close()
+		os.Remove(file.Name())
+		f.spillFailed = true
+		return
+	}
+
+	f.spill = file
+	f.buffer = nil
+}
+
+// Must be called with the mutex held.
+func (f *FanOutWriter) openReaders() int {
+	count := 0
+	for _, r := range f.readers {
+		if !r.closed {
+			count++
+		}
+	}
+	return count
+}
+
+// Must be called with the mutex held.
+func (f *FanOutWriter) trim() {
+	if f.spill != nil {
+		return
+	}
+
+	min := f.written
+	for _, r := range f.readers {
+		if !r.closed && r.offset < min {
+			min = r.offset
+		}
+	}
+	if min > f.base {
+		f.buffer = f.buffer[min-f.base:]
+		f.base = min
+	}
+}
+
+// Must be called with the mutex held. Removes the temporary file once
+// the source is finished and no readers remain.
+func (f *FanOutWriter) cleanup() {
+	if f.spill != nil && f.err != nil && f.openReaders() == 0 {
+		f.spill.Close()
+		os.Remove(f.spill.Name())
+		f.spill = nil
+	}
+}
+
+func (r *FanOutReader) Read(buf []byte) (int, error) {
+	f := r.fanout
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if r.closed {
+		return 0, errors.New("Read from closed FanOutReader.")
+	}
+
+	for r.offset >= f.written && f.err == nil {
+		f.waiting++
+		f.cond.Broadcast()
+		f.cond.Wait()
+		f.waiting--
+	}
+
+	if r.offset >= f.written {
+		return 0, f.err
+	}
+
+	var length int
+	if f.spill != nil {
+		available := f.written - r.offset
+		if int64(len(buf)) > available {
+			buf = buf[0:available]
+		}
+		var err error
+		length, err = f.spill.ReadAt(buf, r.offset)
+		if err != nil && err != io.EOF {
+			return length, err
+		}
+	} else {
+		length = copy(buf, f.buffer[r.offset-f.base:])
+	}
+
+	r.offset += int64(length)
+	f.trim()
+	f.cond.Broadcast()
+	return length, nil
+}
+
+// Size blocks until the source has been fully read, then returns its length.
+func (r *FanOutReader) Size() (int64, error) {
+	f := r.fanout
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for f.err == nil {
+		f.waiting++
+		f.cond.Broadcast()
+		f.cond.Wait()
+		f.waiting--
+	}
+
+	if f.err == io.EOF {
+		return f.written, nil
+	} else {
+		return -1, f.err
+	}
+}
+
+func (r *FanOutReader) Close() error {
+	f := r.fanout
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	r.closed = true
+	f.trim()
+	f.cond.Broadcast()
+	f.cleanup()
+	return nil
+}
@@ -1,13 +1,18 @@
 package main
 
 import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
-	"sort"
+	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -18,6 +23,16 @@ type FileProviderConfig struct {
 
 	MaxSize  int64 `json:"maxsize"`
 	MaxItems int64 `json:"maxitems"`
+
+	//  One of "lru", "soonest-expiry" or "largest-first".
+	EvictionPolicy string `json:"eviction_policy"`
+
+	//  Seconds between integrity scrubs (0 disables them), and what to do
+	//  with corrupt objects: "quarantine" or "delete".
+	ScrubInterval int64  `json:"scrub_interval"`
+	ScrubAction   string `json:"scrub_action"`
+
+	DemoteTo []string `json:"demote_to"`
 }
 
 func NewFileProviderConfig(base BaseProviderConfig, data map[string]interface{}) (*FileProviderConfig, error) {
@@ -59,6 +74,49 @@ func NewFileProviderConfig(base BaseProviderConfig, data map[string]interface{})
 		config.MaxItems = 0
 	}
 
+	policy, ok := data["eviction_policy"]
+	if ok {
+		config.EvictionPolicy, ok = policy.(string)
+		if !ok {
+			return nil, errors.New("File eviction_policy must be a string.")
+		}
+		switch config.EvictionPolicy {
+		case "lru", "soonest-expiry", "largest-first":
+		default:
+			return nil, errors.New("File eviction_policy must be one of \"lru\", \"soonest-expiry\" or \"largest-first\".")
+		}
+	} else {
+		config.EvictionPolicy = "lru"
+	}
+
+	scrubInterval, ok := data["scrub_interval"]
+	if ok {
+		scrubInterval, ok = scrubInterval.(float64)
+		if !ok {
+			return nil, errors.New("File scrub_interval must be a number.")
+		} else {
+			config.ScrubInterval = int64(scrubInterval.(float64))
+		}
+	} else {
+		config.ScrubInterval = 86400
+	}
+
+	scrubAction, ok := data["scrub_action"]
+	if ok {
+		config.ScrubAction, ok = scrubAction.(string)
+		if !ok || (config.ScrubAction != "quarantine" && config.ScrubAction != "delete") {
+			return nil, errors.New("File scrub_action must be \"quarantine\" or \"delete\".")
+		}
+	} else {
+		config.ScrubAction = "quarantine"
+	}
+
+	demoteTo, err := GetStringList(data, "demote_to")
+	if err != nil {
+		return nil, err
+	}
+	config.DemoteTo = demoteTo
+
 	return &config, nil
 }
 
@@ -66,28 +124,80 @@ type FileProvider struct {
 	BaseProvider
 
 	//  Internal stuff that should only be touched from the goroutine
-	cache           map[string]int64
-	sortedCacheKeys []string
-	nextTimestamp   int64
-	currentSize     int64
+	cache       map[string]int64
+	currentSize int64
+
+	//  Objects by expiry time, and by eviction order for the lru and
+	//  largest-first eviction policies.
+	expiries  *KeyHeap
+	evictions *KeyHeap
+
+	//  Last access time written to disk, and size of each object.
+	savedAccess map[string]int64
+	sizes       map[string]int64
+
+	add     chan *FileAddition
+	update  chan *FileObject
+	remove  chan *FileRemoval
+	demoted chan *FileDemotion
+	access  chan string
+	done    chan bool
+
+	index *FileIndex
+
+	//  Held while an object's file and index entry are put in place or
+	//  removed together, so that the index always describes the file.
+	commitMutex sync.Mutex
+
+	scrubMutex sync.Mutex
+	lastScrub  *FileScrubReport
+	scrubDone  chan bool
+}
+
+var ErrFileProviderDisconnected = errors.New("The provider has been disconnected.")
 
-	add    chan *FileObject
-	update chan *FileObject
-	done   chan bool
+// Access times are only written to disk when they've moved by at least
+// this many seconds, so that frequent reads don't turn into writes.
+const FileAccessSaveInterval = 60
+
+// A FileAddition tells the expiry goroutine about an object that was just
+// written by the request in ctx.
+type FileAddition struct {
+	object *FileObject
+	ctx    context.Context
+}
+
+type FileRemoval struct {
+	identifier string
+	result     chan error
+}
+
+type FileDemotion struct {
+	identifier string
+	err        error
 }
 
 func (c FileProviderConfig) NewProvider() (Provider, error) {
 	return &FileProvider{
-		BaseProvider: BaseProvider{c},
+		BaseProvider: NewBaseProvider(c),
+
+		cache:       make(map[string]int64),
+		currentSize: 0,
 
-		cache:           make(map[string]int64),
-		sortedCacheKeys: make([]string, 0),
-		nextTimestamp:   -1,
-		currentSize:     0,
+		expiries:  NewKeyHeap(),
+		evictions: NewKeyHeap(),
 
-		add:    make(chan *FileObject, 10),
-		update: make(chan *FileObject, 10),
-		done:   make(chan bool),
+		savedAccess: make(map[string]int64),
+		sizes:       make(map[string]int64),
+
+		add:     make(chan *FileAddition, 10),
+		update:  make(chan *FileObject, 10),
+		remove:  make(chan *FileRemoval, 10),
+		demoted: make(chan *FileDemotion, 10),
+		access:  make(chan string, 100),
+		done:    make(chan bool),
+
+		scrubDone: make(chan bool),
 	}, nil
 }
 
@@ -95,69 +205,250 @@ func (p *FileProvider) GetConfig() FileProviderConfig {
 	return p.config.(FileProviderConfig)
 }
 
+func (p *FileProvider) Usage() ProviderUsage {
+	config := p.GetConfig()
+	usage := ProviderUsage{
+		MaxItems: config.MaxItems,
+		MaxSize:  config.MaxSize,
+		Details: map[string]interface{}{
+			"last_scrub": p.LastScrub(),
+		},
+	}
+
+	items, bytes := p.index.Totals()
+	usage.Items = int64(items)
+	usage.Bytes = bytes
+
+	if _, err := os.Stat(p.GetFilePath("")); err != nil {
+		usage.Error = err.Error()
+	} else {
+		usage.Healthy = true
+	}
+	return usage
+}
+
 func (p *FileProvider) Connect() error {
-	e := os.MkdirAll(p.GetMetadataPath(""), os.ModeDir|os.ModePerm)
+	e := os.MkdirAll(p.GetFilePath(""), os.ModeDir|os.ModePerm)
 	if e != nil {
-		log.Printf("Could not make dir '%v': %v", p.GetMetadataPath(""), e)
+		log.Printf("Could not make dir '%v': %v", p.GetFilePath(""), e)
 		return e
 	}
 
-	e = os.MkdirAll(p.GetFilePath(""), os.ModeDir|os.ModePerm)
+	//  Anything left in the temporary directory is from an interrupted write.
+	e = os.RemoveAll(p.GetTempPath())
 	if e != nil {
-		log.Printf("Could not make dir '%v': %v", p.GetFilePath(""), e)
+		log.Printf("Could not clear dir '%v': %v", p.GetTempPath(), e)
+		return e
+	}
+
+	e = os.MkdirAll(p.GetTempPath(), os.ModeDir|os.ModePerm)
+	if e != nil {
+		log.Printf("Could not make dir '%v': %v", p.GetTempPath(), e)
+		return e
+	}
+
+	//  Likewise, anything being demoted is still in the cache.
+	e = os.RemoveAll(p.GetDemotePath(""))
+	if e != nil {
+		log.Printf("Could not clear dir '%v': %v", p.GetDemotePath(""), e)
+		return e
+	}
+
+	e = os.MkdirAll(p.GetDemotePath(""), os.ModeDir|os.ModePerm)
+	if e != nil {
+		log.Printf("Could not make dir '%v': %v", p.GetDemotePath(""), e)
+		return e
+	}
+
+	e = p.MigrateFlatLayout()
+	if e != nil {
+		log.Printf("Could not migrate %v to sharded layout: %v", p, e)
 		return e
 	}
+
+	p.index, e = OpenFileIndex(p.GetIndexPath())
+	if e != nil {
+		log.Printf("Could not open index '%v': %v", p.GetIndexPath(), e)
+		return e
+	}
+
+	e = p.ImportMetadata()
+	if e != nil {
+		log.Printf("Could not import metadata into index '%v': %v", p.GetIndexPath(), e)
+		return e
+	}
+
+	//  Fill the cache before any requests are served.
+	p.LoadCache()
 	go p.StartExpiryLoop()
+	go p.StartScrubLoop()
 	return nil
 }
 
-func (p *FileProvider) StartExpiryLoop() {
-	d, err := os.Open(p.GetFilePath(""))
+// Disconnect stops the expiry and scrub loops and closes the index, so that
+// another FileProvider can take over the same path. Requests still being
+// made to this one fail.
+func (p *FileProvider) Disconnect() {
+	p.StopExpiryLoop()
+	p.StopScrubLoop()
+	if p.index != nil {
+		p.index.Close()
+	}
+}
+
+// MigrateFlatLayout moves objects stored directly in files/ (from before
+// the cache was sharded) into their shard directories. They are moved aside
+// first, as an object's id could clash with a shard name.
+func (p *FileProvider) MigrateFlatLayout() error {
+	migrating := p.GetConfig().Path + "/migrating"
+	err := os.MkdirAll(migrating, os.ModeDir|os.ModePerm)
 	if err != nil {
-		log.Printf("Error in expiry loop: %v", err)
-		return
+		return err
+	}
+
+	err = moveRegularFiles(p.GetFilePath(""), func(name string) string {
+		return migrating + "/" + name
+	})
+	if err != nil {
+		return err
+	}
+
+	err = moveRegularFiles(migrating, func(name string) string {
+		return p.GetFilePath(name)
+	})
+	if err != nil {
+		return err
+	}
+
+	return os.RemoveAll(migrating)
+}
+
+// ImportMetadata moves metadata from the one-JSON-file-per-object layout
+// used by earlier versions into the index, then removes the JSON files.
+func (p *FileProvider) ImportMetadata() error {
+	root := p.GetConfig().Path + "/metadata"
+	if _, err := os.Stat(root); os.IsNotExist(err) {
+		return nil
+	}
+
+	imported := 0
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		} else if !info.Mode().IsRegular() || !strings.HasSuffix(info.Name(), ".json") {
+			return nil
+		}
+
+		id := strings.TrimSuffix(info.Name(), ".json")
+		fo, err := p.loadMetadataFrom(path, id)
+		if err != nil {
+			log.Printf("Could not load metadata for object: %v", id)
+			return nil
+		}
+
+		stat, err := os.Stat(p.GetFilePath(id))
+		if err != nil {
+			//  The object itself is gone; drop its metadata.
+			return nil
+		}
+
+		if fo.Accessed == 0 {
+			//  Written before access times were tracked.
+			fo.Accessed = stat.ModTime().Unix()
+		}
+
+		imported++
+		return p.index.Put(FileIndexEntry{Identifier: id, Object: *fo, Size: stat.Size()}, false)
+	})
+	if err != nil {
+		return err
+	}
+
+	err = p.index.Sync()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Imported metadata for %d objects into %v.", imported, p.GetIndexPath())
+	return os.RemoveAll(root)
+}
+
+// LoadCache fills the in-memory cache from the index. Must be called before
+// the expiry loop starts.
+func (p *FileProvider) LoadCache() {
+	for _, entry := range p.index.Entries() {
+		id := entry.Identifier
+		p.cache[id] = entry.Object.Expires
+		p.savedAccess[id] = entry.Object.Accessed
+		p.currentSize += entry.Size
+		p.sizes[id] = entry.Size
+		p.Index(id, entry.Object.Accessed)
 	}
+}
+
+// moveRegularFiles renames every regular file in from to destination(name),
+// creating directories as needed.
+func moveRegularFiles(from string, destination func(string) string) error {
+	d, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
 
 	fi, err := d.Readdir(-1)
 	if err != nil {
-		log.Printf("Error in expiry loop: %v", err)
-		return
+		return err
 	}
 
+	moved := 0
 	for _, fi := range fi {
-		if fi.Mode().IsRegular() {
-			o, err := p.LoadMetadata(fi.Name())
-			if err != nil {
-				log.Printf("Could not load metadata for object: %v", fi.Name())
-			} else {
-				p.cache[fi.Name()] = o.Expires
-				stat, err := os.Stat(p.GetFilePath(fi.Name()))
-				if err != nil {
-					log.Printf("Could not read size of object %v.", fi.Name())
-				} else {
-					p.currentSize += stat.Size()
-				}
-			}
+		if !fi.Mode().IsRegular() {
+			continue
 		}
+
+		path := destination(fi.Name())
+		err = os.MkdirAll(filepath.Dir(path), os.ModeDir|os.ModePerm)
+		if err != nil {
+			return err
+		}
+
+		err = os.Rename(from+"/"+fi.Name(), path)
+		if err != nil {
+			return err
+		}
+		moved++
 	}
 
-	p.sortedCacheKeys = p.GetSortedCacheKeys()
+	if moved > 0 {
+		log.Printf("Moved %d files out of %v.", moved, from)
+	}
+	return nil
+}
+
+func (p *FileProvider) StartExpiryLoop() {
 	p.Expire()
 
 	for {
 		sleepFor := p.NextSleepDuration()
 		select {
-		case ob := <-p.add:
+		case a := <-p.add:
+			ob := a.object
 			p.cache[ob.identifier] = ob.Expires
-			p.sortedCacheKeys = p.GetSortedCacheKeys()
-			p.nextTimestamp = p.GetNextTimestamp()
+			p.savedAccess[ob.identifier] = ob.Accessed
 
 			stat, err := os.Stat(p.GetFilePath(ob.identifier))
 			if err != nil {
 				log.Printf("Could not read size of object %v.", ob.identifier)
 			} else {
-				p.currentSize += stat.Size()
+				p.currentSize += stat.Size() - p.sizes[ob.identifier]
+				p.sizes[ob.identifier] = stat.Size()
+			}
+
+			accessed := ob.Accessed
+			if accessed == 0 {
+				accessed = time.Now().Unix()
 			}
+			p.Index(ob.identifier, accessed)
 
 			maxItems := p.GetConfig().MaxItems
 			if maxItems > 0 {
@@ -165,7 +456,7 @@ func (p *FileProvider) StartExpiryLoop() {
 					if int64(len(p.cache)) < maxItems {
 						break
 					} else {
-						p.RemoveOldest()
+						p.Evict(a.ctx)
 					}
 				}
 			}
@@ -173,23 +464,35 @@ func (p *FileProvider) StartExpiryLoop() {
 			maxSize := p.GetConfig().MaxSize
 			if maxSize > 0 {
 				for {
-					if p.currentSize < maxSize {
+					if p.currentSize < maxSize || len(p.cache) == 0 {
 						break
 					} else {
-						log.Printf("Removing oldest item - max size %d exceeded by %d.", maxSize, p.currentSize)
-						p.RemoveOldest()
+						log.Printf("Evicting an item - max size %d exceeded by %d.", maxSize, p.currentSize)
+						p.Evict(a.ctx)
 					}
 				}
 			}
 		case ob := <-p.update:
-			p.sortedCacheKeys = p.GetSortedCacheKeys()
-			p.nextTimestamp = p.GetNextTimestamp()
-			p.cache[ob.identifier] = ob.Expires
+			if _, ok := p.cache[ob.identifier]; ok {
+				p.cache[ob.identifier] = ob.Expires
+				p.expiries.Set(ob.identifier, ob.Expires)
+			}
+		case r := <-p.remove:
+			if _, err := os.Stat(p.GetFilePath(r.identifier)); os.IsNotExist(err) {
+				//  Nothing to delete, but clear out any orphaned metadata.
+				p.Forget(r.identifier)
+				p.index.Delete(r.identifier)
+				r.result <- nil
+			} else {
+				r.result <- p.Remove(r.identifier)
+			}
+		case d := <-p.demoted:
+			p.FinishDemotion(d)
+		case id := <-p.access:
+			p.RecordAccess(id)
 		case <-p.done:
-			break
+			return
 		case <-time.After(sleepFor):
-			p.sortedCacheKeys = p.GetSortedCacheKeys()
-			p.nextTimestamp = p.GetNextTimestamp()
 			p.Expire()
 			break
 		}
@@ -198,8 +501,9 @@ func (p *FileProvider) StartExpiryLoop() {
 
 func (p *FileProvider) NextSleepDuration() time.Duration {
 	now := time.Now().Unix()
-	if p.nextTimestamp > 0 {
-		secs := p.nextTimestamp - now
+	next := p.GetNextTimestamp()
+	if next > 0 {
+		secs := next - now
 		if secs > 0 {
 			return (time.Duration(secs) * time.Second)
 		} else {
@@ -211,145 +515,319 @@ func (p *FileProvider) NextSleepDuration() time.Duration {
 	}
 }
 
-func (p *FileProvider) RemoveOldest() {
-	if len(p.sortedCacheKeys) > 0 {
-		lastIndex := len(p.sortedCacheKeys) - 1
-		if lastIndex < 0 {
-			return
-		}
-		p.Remove(p.sortedCacheKeys[lastIndex])
-		maxElement := len(p.sortedCacheKeys) - 2
-		if maxElement < 0 {
-			maxElement = 0
-		}
-		p.sortedCacheKeys = p.sortedCacheKeys[0:maxElement]
+// EvictionCandidate picks the next object to evict according to the
+// eviction policy, or returns "" if the cache is empty.
+func (p *FileProvider) EvictionCandidate() string {
+	var key string
+	if p.GetConfig().EvictionPolicy == "soonest-expiry" {
+		key, _, _ = p.expiries.Peek()
+	} else {
+		key, _, _ = p.evictions.Peek()
 	}
+	return key
 }
 
-func (p *FileProvider) Remove(key string) error {
-	stat, err := os.Stat(p.GetFilePath(key))
-	if err != nil {
-		log.Printf("Could not read size of object %v.", key)
-		return err
+// Index adds or moves key in the expiry and eviction heaps.
+func (p *FileProvider) Index(key string, accessed int64) {
+	p.expiries.Set(key, p.cache[key])
+
+	switch p.GetConfig().EvictionPolicy {
+	case "lru":
+		p.evictions.Set(key, accessed)
+	case "largest-first":
+		p.evictions.Set(key, -p.sizes[key])
+	}
+}
+
+func (p *FileProvider) Evict(ctx context.Context) {
+	key := p.EvictionCandidate()
+	if key == "" {
+		return
+	}
+	p.Counters().RecordEviction()
+
+	var err error
+	if len(p.GetConfig().DemoteTo) > 0 {
+		err = p.Demote(ctx, key)
 	} else {
-		p.currentSize -= stat.Size()
+		err = p.Remove(key)
+	}
+
+	if err != nil {
+		//  Stop tracking it anyway, so that eviction can make progress.
+		log.Printf("Could not evict object %v: %v", key, err)
+		p.Forget(key)
+	}
+}
+
+// Forget removes an object from the in-memory cache state.
+func (p *FileProvider) Forget(key string) {
+	p.currentSize -= p.sizes[key]
+	delete(p.cache, key)
+	delete(p.savedAccess, key)
+	delete(p.sizes, key)
+	p.expiries.Remove(key)
+	p.evictions.Remove(key)
+}
+
+func (p *FileProvider) RecordAccess(id string) {
+	if _, ok := p.cache[id]; !ok {
+		return
 	}
 
-	err = os.Remove(p.GetFilePath(key))
+	now := time.Now().Unix()
+	if p.GetConfig().EvictionPolicy == "lru" {
+		p.evictions.Set(id, now)
+	}
+
+	if now-p.savedAccess[id] >= FileAccessSaveInterval {
+		_, err := p.ModifyMetadata(id, func(fo *FileObject) {
+			fo.Accessed = now
+		})
+		if err != nil {
+			log.Printf("Could not save access time for object %v: %v", id, err)
+		} else {
+			p.savedAccess[id] = now
+		}
+	}
+}
+
+func (p *FileProvider) Remove(key string) error {
+	p.commitMutex.Lock()
+	defer p.commitMutex.Unlock()
+
+	err := os.Remove(p.GetFilePath(key))
 	if err != nil {
 		log.Printf("Could not remove object %v: %v", key, err)
 		return err
 	} else {
 		log.Printf("Removing object %v from local filesystem cache.", key)
-		err = os.Remove(p.GetMetadataPath(key))
+		p.Forget(key)
+		err = p.index.Delete(key)
 		if err != nil {
 			log.Printf("Could not remove metadata for %v: %v", key, err)
-			return err
-		} else {
-			delete(p.cache, key)
-			return nil
 		}
+		return err
 	}
 }
 
-type SortedMap struct {
-	m map[string]int64
-	s []string
-}
+// Demote stops tracking an object, so that it no longer counts towards the
+// provider's limits, then copies it to the demote_to providers in the
+// background. The object is served from here until it's been copied.
+func (p *FileProvider) Demote(ctx context.Context, key string) error {
+	fo, err := p.LoadMetadata(key)
+	if err != nil {
+		log.Printf("Could not load metadata for object %v to demote: %v", key, err)
+		return p.Remove(key)
+	}
 
-func (sm *SortedMap) Len() int {
-	return len(sm.m)
-}
+	//  Copy from a link to the object, so that the copy isn't affected if
+	//  the object is removed or replaced in the meantime.
+	snapshot := p.GetDemotePath(key)
+	err = os.Link(p.GetFilePath(key), snapshot)
+	if err != nil {
+		log.Printf("Could not stage object %v for demotion: %v", key, err)
+		return p.Remove(key)
+	}
+
+	p.Forget(key)
+	go func() {
+		defer os.Remove(snapshot)
 
-func (sm *SortedMap) Less(i, j int) bool {
-	return sm.m[sm.s[i]] > sm.m[sm.s[j]]
+		targets := GetTargetProviders(key, p, p.GetConfig().DemoteTo)
+		open := func() (Object, error) {
+			file, err := os.Open(snapshot)
+			if err != nil {
+				return nil, err
+			}
+			return p.Decrypt(&FileObject{BaseObject: fo.BaseObject, File: file})
+		}
+		d := &FileDemotion{
+			identifier: key,
+			err:        Demote(DetachedContext(ctx), fo.BaseObject, p, open, targets),
+		}
+		select {
+		case p.demoted <- d:
+		case <-p.done:
+		}
+	}()
+	return nil
 }
 
-func (sm *SortedMap) Swap(i, j int) {
-	sm.s[i], sm.s[j] = sm.s[j], sm.s[i]
+// FinishDemotion removes an object once it's been demoted, or starts
+// tracking it again if it couldn't be, so that it can be retried when it's
+// next evicted. Objects that have been written afresh in the meantime are
+// left alone.
+func (p *FileProvider) FinishDemotion(d *FileDemotion) {
+	if _, ok := p.cache[d.identifier]; ok {
+		return
+	}
+
+	stat, err := os.Stat(p.GetFilePath(d.identifier))
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		log.Printf("Could not find demoted object %v: %v", d.identifier, err)
+		return
+	}
+
+	if d.err == nil {
+		p.Remove(d.identifier)
+		return
+	}
+
+	fo, err := p.LoadMetadata(d.identifier)
+	if err != nil {
+		log.Printf("Could not load metadata for object %v: %v", d.identifier, err)
+		return
+	}
+
+	p.cache[d.identifier] = fo.Expires
+	p.savedAccess[d.identifier] = fo.Accessed
+	p.currentSize += stat.Size()
+	p.sizes[d.identifier] = stat.Size()
+	p.Index(d.identifier, time.Now().Unix())
 }
 
 func (p *FileProvider) GetNextTimestamp() int64 {
-	keys := p.sortedCacheKeys
-	if len(keys) > 0 {
-		return p.cache[keys[0]]
+	_, expires, ok := p.expiries.Peek()
+	if ok {
+		return expires
 	} else {
 		return -1
 	}
 }
 
-func (p *FileProvider) GetSortedCacheKeys() []string {
-	sm := new(SortedMap)
-	sm.m = p.cache
-	sm.s = make([]string, len(sm.m))
-	i := 0
-	for key, _ := range sm.m {
-		sm.s[i] = key
-		i++
-	}
-	sort.Sort(sort.Reverse(sm))
-	return sm.s
-}
-
 func (p *FileProvider) Expire() {
 	now := time.Now().Unix()
-	for _, key := range p.sortedCacheKeys {
-		expiry := p.cache[key]
-		if expiry <= now {
-			p.nextTimestamp = -1
-			err := p.Remove(key)
-			if err != nil {
-				log.Printf("Could not expire key %v: %v", key, err)
-				continue
-			}
-		} else {
-			p.nextTimestamp = expiry
+	for {
+		key, expiry, ok := p.expiries.Peek()
+		if !ok || expiry > now {
 			break
 		}
+		p.Counters().RecordExpirations(1)
+
+		err := p.Remove(key)
+		if err != nil {
+			//  Stop tracking it anyway, so that expiry can make progress.
+			log.Printf("Could not expire key %v: %v", key, err)
+			p.Forget(key)
+		}
 	}
 }
 
 func (p *FileProvider) StopExpiryLoop() {
-	p.done <- true
+	close(p.done)
 }
 
-func (p *FileProvider) GetFilePath(id string) string {
-	return p.GetConfig().Path + "/files/" + id
+// GetShard returns the directory, two levels deep, that an object is stored
+// in, so that no single directory grows too large.
+func (p *FileProvider) GetShard(id string) string {
+	sum := md5.Sum([]byte(id))
+	prefix := hex.EncodeToString(sum[0:2])
+	return prefix[0:2] + "/" + prefix[2:4] + "/"
 }
 
-func (p *FileProvider) GetMetadataPath(id string) string {
+func (p *FileProvider) GetFilePath(id string) string {
 	if len(id) > 0 {
-		return p.GetConfig().Path + "/metadata/" + id + ".json"
+		return p.GetConfig().Path + "/files/" + p.GetShard(id) + id
 	} else {
-		return p.GetConfig().Path + "/metadata/"
+		return p.GetConfig().Path + "/files/"
 	}
 }
 
-func (p *FileProvider) SaveMetadata(o FileObject) error {
-	data, err := json.Marshal(o)
+func (p *FileProvider) GetIndexPath() string {
+	return p.GetConfig().Path + "/index.log"
+}
+
+func (p *FileProvider) GetTempPath() string {
+	return p.GetConfig().Path + "/tmp/"
+}
+
+// GetDemotePath returns where an object is linked while it's demoted. The
+// scrubber leaves it alone, however long the copy takes.
+func (p *FileProvider) GetDemotePath(id string) string {
+	return p.GetConfig().Path + "/demoting/" + id
+}
+
+// CreateTempFile opens a new file to be written and then moved into place
+// with CommitTempFile.
+func (p *FileProvider) CreateTempFile() (*os.File, error) {
+	file, err := ioutil.TempFile(p.GetTempPath(), "write-")
 	if err != nil {
-		return err
-	} else {
-		metadataPath := p.GetMetadataPath(o.BaseObject.identifier)
-		f, err := os.Create(metadataPath)
-		if err != nil {
-			return err
-		} else {
-			l, err := f.Write(data)
-			if err != nil || l < len(data) {
-				os.Remove(metadataPath)
-				f.Close()
-				return err
-			} else {
-				f.Close()
-				return nil
-			}
+		return nil, err
+	}
+
+	err = file.Chmod(0644)
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return file, nil
+}
+
+// CommitTempFile flushes a file from CreateTempFile to disk, closes it, and
+// links it into place at path. If something is already there, it's only
+// replaced if replace returns true; otherwise the error satisfies
+// os.IsExist. The temporary file is removed either way.
+func (p *FileProvider) CommitTempFile(file *os.File, path string, replace func() bool) error {
+	err := file.Sync()
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(path), os.ModeDir|os.ModePerm)
+	}
+
+	if err == nil {
+		err = os.Link(file.Name(), path)
+		if os.IsExist(err) && replace() {
+			err = os.Rename(file.Name(), path)
 		}
 	}
+
+	os.Remove(file.Name())
+	return err
 }
 
+// ModifyMetadata applies f to an object's metadata and records the result
+// in the index, keeping the size that was recorded when it was written. It
+// returns an error satisfying os.IsNotExist if the object isn't in the index.
+func (p *FileProvider) ModifyMetadata(id string, f func(*FileObject)) (*FileObject, error) {
+	var fo FileObject
+	err := p.index.Modify(id, func(entry *FileIndexEntry) {
+		f(&entry.Object)
+		fo = entry.Object
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	fo.BaseObject.identifier = id
+	fo.BaseObject.exists = true
+	fo.BaseObject.provider = p
+	return &fo, nil
+}
+
+// LoadMetadata returns an error satisfying os.IsNotExist if the object
+// isn't in the index.
 func (p *FileProvider) LoadMetadata(id string) (*FileObject, error) {
-	file, e := ioutil.ReadFile(p.GetMetadataPath(id))
+	entry, ok := p.index.Get(id)
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+
+	fo := entry.Object
+	fo.BaseObject.identifier = id
+	fo.BaseObject.exists = true
+	fo.BaseObject.provider = p
+	return &fo, nil
+}
+
+func (p *FileProvider) loadMetadataFrom(path string, id string) (*FileObject, error) {
+	file, e := ioutil.ReadFile(path)
 	if e != nil {
 		return nil, e
 	}
@@ -367,7 +845,7 @@ func (p *FileProvider) LoadMetadata(id string) (*FileObject, error) {
 	}
 }
 
-func (p *FileProvider) Get(id string) (Object, error) {
+func (p *FileProvider) Get(ctx context.Context, id string) (Object, error) {
 	file, err := os.Open(p.GetFilePath(id))
 	if err != nil || file == nil {
 		if file != nil {
@@ -381,104 +859,208 @@ func (p *FileProvider) Get(id string) (Object, error) {
 	} else {
 		obj, err := p.LoadMetadata(id)
 		if err != nil || file == nil {
-			return nil, err
+			file.Close()
+			if os.IsNotExist(err) {
+				//  Left behind by an interrupted write.
+				return nil, nil
+			} else {
+				return nil, err
+			}
 		} else {
 			obj.File = file
-			return obj, nil
+			if stat, err := file.Stat(); err == nil {
+				obj.modified = stat.ModTime()
+			}
+
+			//  Don't hold up the read if the expiry loop is busy.
+			select {
+			case p.access <- id:
+			default:
+			}
+			return p.Decrypt(obj)
 		}
 	}
 }
 
-func (p *FileProvider) GetURL(id string) (Object, error) {
-	return nil, nil
+func (p *FileProvider) Stat(ctx context.Context, id string) (Object, error) {
+	stat, err := os.Stat(p.GetFilePath(id))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	fo, err := p.LoadMetadata(id)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	bo := fo.BaseObject
+	bo.modified = stat.ModTime()
+	return p.Decrypt(&StatObject{BaseObject: bo, size: stat.Size()})
 }
 
-func (p *FileProvider) Put(o Object) (Object, error) {
-	objectPath := p.GetFilePath(o.GetBaseObject().identifier)
+func (p *FileProvider) GetURL(ctx context.Context, id string, expires time.Time) (Object, error) {
+	_, err := os.Stat(p.GetFilePath(id))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
 
-	if _, exists := p.cache[o.GetBaseObject().identifier]; exists {
-		return p.Update(o)
+	url, err := p.LocalURL(id)
+	if err != nil {
+		return nil, err
 	} else {
-		file, err := os.OpenFile(objectPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
-		if file != nil {
-			defer file.Close()
+		return NewURLObject(id, url, p), nil
+	}
+}
+
+func (p *FileProvider) Put(ctx context.Context, o Object) (Object, error) {
+	id := o.GetBaseObject().identifier
+	objectPath := p.GetFilePath(id)
+
+	//  A file without an index entry was left by an interrupted write, and
+	//  is replaced below.
+	if _, err := os.Stat(objectPath); err == nil {
+		if _, indexed := p.index.Get(id); indexed {
+			return p.Update(ctx, o)
 		}
-		if err != nil {
-			if os.IsExist(err) {
-				return p.Update(o)
-			} else {
-				return nil, err
-			}
-		} else {
-			fo := FileObject{
-				BaseObject: o.GetBaseObject(),
-				File:       file,
-			}
-			data := make([]byte, 4096)
-			for {
-				length, err := o.Read(data)
-				if length == 0 || (err != nil && err != io.EOF) {
-					break
-				} else {
-					file.Write(data[0:length])
-				}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
 
-				if err == io.EOF {
-					break
-				}
-			}
+	o, err := p.Compress(o)
+	if err != nil {
+		return nil, err
+	}
+	defer o.Close()
 
-			if err != nil {
-				os.Remove(file.Name())
-				return nil, err
-			}
+	o, err = p.Encrypt(o)
+	if err != nil {
+		return nil, err
+	}
 
-			err = p.SaveMetadata(fo)
+	//  Write to a temporary file, so that a partially-written object is
+	//  never visible, then move it into place.
+	file, err := p.CreateTempFile()
+	if err != nil {
+		return nil, err
+	}
+
+	fo := FileObject{
+		BaseObject: o.GetBaseObject(),
+		Accessed:   time.Now().Unix(),
+	}
+	var written int64
+	data := make([]byte, 4096)
+	for {
+		length, rerr := o.Read(data)
+		if length > 0 {
+			_, err = file.Write(data[0:length])
 			if err != nil {
-				return nil, err
-			} else {
-				p.add <- &fo
-				return &fo, nil
+				break
 			}
+			written += int64(length)
+		}
+
+		if rerr == io.EOF {
+			break
+		} else if rerr != nil {
+			err = rerr
+			break
+		}
+	}
+
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+
+	//  Now that the object's been read, its ETag is known. The file is
+	//  only linked into place if no other writer got there first, and the
+	//  object isn't visible until its metadata is written after it.
+	fo.BaseObject = o.GetBaseObject()
+	p.commitMutex.Lock()
+	err = p.CommitTempFile(file, objectPath, func() bool {
+		_, indexed := p.index.Get(id)
+		return !indexed
+	})
+	if os.IsExist(err) {
+		p.commitMutex.Unlock()
+		return p.Update(ctx, o)
+	}
+	if err == nil {
+		err = p.index.Put(FileIndexEntry{Identifier: id, Object: fo, Size: written}, true)
+		if err != nil {
+			os.Remove(objectPath)
 		}
 	}
+	p.commitMutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case p.add <- &FileAddition{object: &fo, ctx: ctx}:
+	case <-p.done:
+	}
+	return &fo, nil
 }
 
-func (p *FileProvider) Update(o Object) (Object, error) {
+func (p *FileProvider) Update(ctx context.Context, o Object) (Object, error) {
 	bo := o.GetBaseObject()
 
-	fo := FileObject{
-		BaseObject: bo,
+	//  Only the expiry changes. The rest of the stored metadata - its
+	//  encoding, checksum and wrapped encryption key - describes the bytes
+	//  on disk, which aren't being replaced.
+	fo, err := p.ModifyMetadata(bo.identifier, func(fo *FileObject) {
+		fo.Expires = bo.Expires
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	if _, ok := p.cache[bo.identifier]; ok {
-		p.add <- &fo
-		err := p.SaveMetadata(fo)
-		if err != nil {
-			return nil, err
-		} else {
-			return &fo, nil
-		}
-	} else {
-		//  Check the disk
-		fo, err := p.LoadMetadata(bo.identifier)
-		if err != nil {
-			return nil, err
-		} else {
-			fo.Expires = bo.Expires
-			err = p.SaveMetadata(*fo)
-			if err != nil {
-				return nil, err
-			} else {
-				return fo, err
-			}
-		}
+	select {
+	case p.update <- fo:
+	case <-p.done:
+	}
+	return fo, nil
+}
+
+func (p *FileProvider) Delete(ctx context.Context, id string) error {
+	//  Removal must happen on the expiry goroutine, as it owns the cache.
+	//  The remove channel is buffered, so a disconnected provider must be
+	//  caught before sending, or the removal could sit there unanswered.
+	select {
+	case <-p.done:
+		return ErrFileProviderDisconnected
+	default:
+	}
+
+	result := make(chan error, 1)
+	select {
+	case p.remove <- &FileRemoval{identifier: id, result: result}:
+	case <-p.done:
+		return ErrFileProviderDisconnected
+	}
+	select {
+	case err := <-result:
+		return err
+	case <-p.done:
+		return ErrFileProviderDisconnected
 	}
 }
 
 type FileObject struct {
 	BaseObject `json:"base"`
 
+	//  Unix time of the last Get, for LRU eviction.
+	Accessed int64 `json:"accessed"`
+
 	File *os.File `json:"-"`
 }
 
@@ -495,6 +1077,10 @@ func (f *FileObject) Read(buf []byte) (int, error) {
 	return f.File.Read(buf)
 }
 
+func (f *FileObject) Seek(offset int64, whence int) (int64, error) {
+	return f.File.Seek(offset, whence)
+}
+
 func (f *FileObject) Close() error {
 	if f.File == nil {
 		return nil
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newBenchmarkFileProvider connects a FileProvider in a temporary directory
+// whose index already holds resident objects. Their files don't exist, but
+// nothing reads them: they only fill the expiry and eviction orders.
+func newBenchmarkFileProvider(b *testing.B, resident int) (*FileProvider, func()) {
+	dir, err := ioutil.TempDir("", "till-benchmark-")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	index, err := OpenFileIndex(dir + "/index")
+	if err != nil {
+		b.Fatal(err)
+	}
+	now := time.Now().Unix()
+	for i := 0; i < resident; i++ {
+		id := "resident-" + strconv.Itoa(i)
+		fo := FileObject{
+			BaseObject: BaseObject{Expires: now + 3600 + int64(i)},
+			Accessed:   now - int64(i),
+		}
+		err = index.Put(FileIndexEntry{Identifier: id, Object: fo, Size: 64}, false)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	index.Close()
+
+	config := FileProviderConfig{Path: dir, EvictionPolicy: "lru"}
+	provider, _ := config.NewProvider()
+	p := provider.(*FileProvider)
+	err = p.Connect()
+	if err != nil {
+		b.Fatal(err)
+	}
+	return p, func() {
+		p.Disconnect()
+		os.RemoveAll(dir)
+	}
+}
+
+// Put latency shouldn't grow with the number of objects already stored.
+func BenchmarkFileProviderPut(b *testing.B) {
+	data := strings.Repeat("x", 1024)
+	for _, resident := range []int{1000, 10000, 100000, 500000} {
+		b.Run(strconv.Itoa(resident), func(b *testing.B) {
+			p, cleanup := newBenchmarkFileProvider(b, resident)
+			defer cleanup()
+			expires := time.Now().Unix() + 3600
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				o := &UploadObject{
+					BaseObject: BaseObject{identifier: "put-" + strconv.Itoa(i), Expires: expires},
+					reader:     ioutil.NopCloser(strings.NewReader(data)),
+					size:       int64(len(data)),
+				}
+				if _, err := p.Put(context.Background(), o); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
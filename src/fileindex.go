@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+/*
+ *  FileIndex keeps the metadata of every object in a FileProvider in a
+ *  single append-only log of JSON records, one per line. Each record
+ *  replaces any earlier one for the same id. On open, the log is replayed
+ *  into memory; once it holds too many superseded records, it's rewritten
+ *  with just the live ones. That happens in the background, from a snapshot
+ *  of the entries: records appended in the meantime go to the old log, and
+ *  are copied to the new one as it's swapped in.
+ */
+
+// The log is compacted once it has this many more records than objects.
+const FileIndexCompactionSlack = 10000
+
+var ErrFileIndexClosed = errors.New("The index has been closed.")
+
+type FileIndexEntry struct {
+	Identifier string     `json:"id"`
+	Deleted    bool       `json:"deleted,omitempty"`
+	Object     FileObject `json:"object"`
+	Size       int64      `json:"size"`
+}
+
+type FileIndex struct {
+	path string
+
+	mutex   sync.Mutex
+	file    *os.File
+	entries map[string]FileIndexEntry
+	records int
+
+	//  The total size of the live entries, kept as they change so that
+	//  usage can be reported without walking them.
+	bytes int64
+
+	//  Whether the log is being compacted, and the records appended since
+	//  the compaction's snapshot was taken.
+	compacting bool
+	pending    [][]byte
+}
+
+// OpenFileIndex replays the log at path, creating it if it doesn't exist.
+func OpenFileIndex(path string) (*FileIndex, error) {
+	index := &FileIndex{
+		path:    path,
+		entries: make(map[string]FileIndexEntry),
+	}
+
+	file, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	} else if err == nil {
+		//  Records are read whole, however long, so that no single record
+		//  can stop the index being opened.
+		reader := bufio.NewReader(file)
+		for {
+			line, rerr := reader.ReadBytes('\n')
+			if len(bytes.TrimSpace(line)) > 0 {
+				var entry FileIndexEntry
+				if err := json.Unmarshal(line, &entry); err != nil {
+					//  Most likely a record torn by a crash; skip it.
+					log.Printf("Skipping unreadable record in %v: %v", path, err)
+				} else {
+					index.records++
+					if entry.Deleted {
+						index.remove(entry.Identifier)
+					} else {
+						index.set(entry)
+					}
+				}
+			}
+
+			if rerr == io.EOF {
+				break
+			} else if rerr != nil {
+				file.Close()
+				return nil, rerr
+			}
+		}
+		file.Close()
+	}
+
+	//  Always start from a compacted log, which also drops any torn record.
+	err = index.compact()
+	if err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+func (i *FileIndex) Get(id string) (FileIndexEntry, bool) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	entry, ok := i.entries[id]
+	return entry, ok
+}
+
+// Entries returns a snapshot of every live entry in the index.
+func (i *FileIndex) Entries() []FileIndexEntry {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	return i.snapshot()
+}
+
+// Totals returns the number of live entries and their total size.
+func (i *FileIndex) Totals() (int, int64) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	return len(i.entries), i.bytes
+}
+
+// Must be called with the mutex held, or before the index is shared.
+func (i *FileIndex) set(entry FileIndexEntry) {
+	i.remove(entry.Identifier)
+	i.entries[entry.Identifier] = entry
+	i.bytes += entry.Size
+}
+
+// Must be called with the mutex held, or before the index is shared.
+func (i *FileIndex) remove(id string) {
+	if entry, ok := i.entries[id]; ok {
+		delete(i.entries, id)
+		i.bytes -= entry.Size
+	}
+}
+
+// Must be called with the mutex held.
+func (i *FileIndex) snapshot() []FileIndexEntry {
+	entries := make([]FileIndexEntry, 0, len(i.entries))
+	for _, entry := range i.entries {
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// Put records entry, and flushes the log to disk if sync is set.
+func (i *FileIndex) Put(entry FileIndexEntry, sync bool) error {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	entry.Deleted = false
+	err := i.append(entry, sync)
+	if err != nil {
+		return err
+	}
+	i.set(entry)
+	i.maybeCompact()
+	return nil
+}
+
+// Modify applies f to the entry for id and records the result, under the
+// same lock, so that concurrent changes to an entry aren't lost. It returns
+// os.ErrNotExist if there's no entry for id.
+func (i *FileIndex) Modify(id string, f func(*FileIndexEntry)) error {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	entry, ok := i.entries[id]
+	if !ok {
+		return os.ErrNotExist
+	}
+
+	f(&entry)
+	entry.Identifier = id
+	entry.Deleted = false
+	err := i.append(entry, false)
+	if err != nil {
+		return err
+	}
+	i.set(entry)
+	i.maybeCompact()
+	return nil
+}
+
+func (i *FileIndex) Delete(id string) error {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	if _, ok := i.entries[id]; !ok {
+		return nil
+	}
+
+	err := i.append(FileIndexEntry{Identifier: id, Deleted: true}, false)
+	if err != nil {
+		return err
+	}
+	i.remove(id)
+	i.maybeCompact()
+	return nil
+}
+
+// Sync flushes the log to disk.
+func (i *FileIndex) Sync() error {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	if i.file == nil {
+		return ErrFileIndexClosed
+	}
+	return i.file.Sync()
+}
+
+func (i *FileIndex) Close() error {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	if i.file == nil {
+		return nil
+	}
+	err := i.file.Close()
+	i.file = nil
+	return err
+}
+
+// Must be called with the mutex held.
+func (i *FileIndex) append(entry FileIndexEntry, sync bool) error {
+	if i.file == nil {
+		return ErrFileIndexClosed
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	data = append(data, '\n')
+	_, err = i.file.Write(data)
+	if err != nil {
+		return err
+	}
+	i.records++
+	if i.compacting {
+		i.pending = append(i.pending, data)
+	}
+
+	if sync {
+		return i.file.Sync()
+	} else {
+		return nil
+	}
+}
+
+// Must be called with the mutex held. Starts compacting the log in the
+// background, if it's grown enough and that isn't already under way.
+func (i *FileIndex) maybeCompact() {
+	if i.compacting || i.records <= 2*len(i.entries)+FileIndexCompactionSlack {
+		return
+	}
+
+	i.compacting = true
+	go i.compactInBackground(i.snapshot())
+}
+
+func (i *FileIndex) compactInBackground(entries []FileIndexEntry) {
+	temp, err := i.writeLog(entries)
+
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	pending := i.pending
+	i.compacting = false
+	i.pending = nil
+
+	if err == nil && i.file == nil {
+		//  Closed in the meantime.
+		temp.Close()
+		os.Remove(temp.Name())
+		return
+	}
+	if err == nil {
+		err = i.replaceLog(temp, len(entries), pending)
+	}
+	if err != nil {
+		log.Printf("Could not compact %v: %v", i.path, err)
+	}
+}
+
+// Must be called with the mutex held, or before the index is shared.
+// Rewrites the log with just the live entries.
+func (i *FileIndex) compact() error {
+	entries := i.snapshot()
+	temp, err := i.writeLog(entries)
+	if err != nil {
+		return err
+	}
+	return i.replaceLog(temp, len(entries), nil)
+}
+
+// writeLog writes entries to a new log beside the index, and flushes it to
+// disk. The new log is removed if anything fails.
+func (i *FileIndex) writeLog(entries []FileIndexEntry) (*os.File, error) {
+	temp, err := ioutil.TempFile(filepath.Dir(i.path), filepath.Base(i.path)+".")
+	if err != nil {
+		return nil, err
+	}
+
+	writer := bufio.NewWriter(temp)
+	for _, entry := range entries {
+		data, err := json.Marshal(entry)
+		if err == nil {
+			_, err = writer.Write(append(data, '\n'))
+		}
+		if err != nil {
+			temp.Close()
+			os.Remove(temp.Name())
+			return nil, err
+		}
+	}
+
+	err = writer.Flush()
+	if err == nil {
+		err = temp.Sync()
+	}
+	if err != nil {
+		temp.Close()
+		os.Remove(temp.Name())
+		return nil, err
+	}
+	return temp, nil
+}
+
+// Must be called with the mutex held. Adds the pending records to a log
+// from writeLog that holds the given number of records, and atomically
+// replaces the old log with it. The new log is removed if anything fails.
+func (i *FileIndex) replaceLog(temp *os.File, records int, pending [][]byte) error {
+	var err error
+	for _, data := range pending {
+		_, err = temp.Write(data)
+		if err != nil {
+			break
+		}
+	}
+	if err == nil && len(pending) > 0 {
+		err = temp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), i.path)
+	}
+	if err != nil {
+		temp.Close()
+		os.Remove(temp.Name())
+		return err
+	}
+
+	if i.file != nil {
+		i.file.Close()
+	}
+	i.file = temp
+	i.records = records + len(pending)
+	return nil
+}
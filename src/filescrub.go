@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+/*
+ *  The scrubber periodically reconciles a FileProvider's files/ directory
+ *  against its index. It removes objects with no index record, drops index
+ *  records with no object, clears out abandoned temporary files, and checks
+ *  every object against the MD5 digest stored as its ETag and the SHA-256
+ *  stored as its checksum, quarantining (or deleting) any that don't match.
+ */
+
+// Anything younger than this may belong to a write that's still in progress,
+// so the scrubber leaves it alone.
+const FileScrubGracePeriod = 10 * time.Minute
+
+var md5HexPattern = regexp.MustCompile("^[0-9a-f]{32}$")
+
+type FileScrubReport struct {
+	Started  int64 `json:"started"`
+	Finished int64 `json:"finished"`
+
+	Checked       int   `json:"checked"`
+	CheckedBytes  int64 `json:"checked_bytes"`
+	OrphanedFiles int   `json:"orphaned_files"`
+	OrphanedBytes int64 `json:"orphaned_bytes"`
+	MissingFiles  int   `json:"missing_files"`
+	TempFiles     int   `json:"temp_files"`
+	Corrupt       int   `json:"corrupt"`
+	Errors        int   `json:"errors"`
+}
+
+func (p *FileProvider) StartScrubLoop() {
+	interval := p.GetConfig().ScrubInterval
+	if interval <= 0 {
+		return
+	}
+
+	for {
+		select {
+		case <-p.scrubDone:
+			return
+		case <-time.After(time.Duration(interval) * time.Second):
+			report := p.Scrub()
+
+			p.scrubMutex.Lock()
+			p.lastScrub = report
+			p.scrubMutex.Unlock()
+		}
+	}
+}
+
+func (p *FileProvider) StopScrubLoop() {
+	close(p.scrubDone)
+}
+
+func (p *FileProvider) LastScrub() *FileScrubReport {
+	p.scrubMutex.Lock()
+	defer p.scrubMutex.Unlock()
+	return p.lastScrub
+}
+
+func (p *FileProvider) Scrub() *FileScrubReport {
+	report := &FileScrubReport{Started: time.Now().Unix()}
+	log.Printf("Scrubbing %v...", p)
+
+	cutoff := time.Now().Add(-FileScrubGracePeriod)
+
+	//  Objects that aren't in the index, or don't match their digest.
+	err := filepath.Walk(p.GetFilePath(""), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			log.Printf("Could not scrub %v: %v", path, err)
+			report.Errors++
+			return nil
+		} else if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		id := info.Name()
+		entry, ok := p.index.Get(id)
+		if !ok {
+			if info.ModTime().Before(cutoff) {
+				log.Printf("Removing orphaned object %v.", id)
+				if err := os.Remove(path); err != nil {
+					report.Errors++
+				} else {
+					report.OrphanedFiles++
+					report.OrphanedBytes += info.Size()
+				}
+			}
+			return nil
+		}
+
+		//  An encrypted object's digests are sealed in its metadata. If they
+		//  can't be unsealed, there's nothing to check against.
+		bo := entry.Object.BaseObject
+		bo.identifier = id
+		expected, _, _ := DecryptMetadata(bo, p.GetConfig().EncryptionKeys())
+		if !md5HexPattern.MatchString(expected.ETag) && len(expected.Checksum) == 0 {
+			//  No digest to check against.
+			return nil
+		}
+
+		digest, checksum, err := p.objectDigests(id, path, bo)
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			log.Printf("Could not read object %v: %v", id, err)
+			report.Errors++
+			return nil
+		}
+
+		report.Checked++
+		report.CheckedBytes += info.Size()
+		corrupt := false
+		//  The checksum is always of the object itself, but an ETag may have
+		//  come from a backend, so it's only checked if there's no checksum.
+		if len(expected.Checksum) > 0 {
+			if checksum != expected.Checksum {
+				log.Printf("Object %v does not match its checksum (expected %v, got %v).", id, expected.Checksum, checksum)
+				corrupt = true
+			}
+		} else if md5HexPattern.MatchString(expected.ETag) && digest != expected.ETag {
+			log.Printf("Object %v does not match its digest (expected %v, got %v).", id, expected.ETag, digest)
+			corrupt = true
+		}
+
+		if corrupt {
+			report.Corrupt++
+			if err := p.DiscardCorrupt(id); err != nil {
+				log.Printf("Could not discard corrupt object %v: %v", id, err)
+				report.Errors++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		report.Errors++
+	}
+
+	//  Index records whose objects have gone missing.
+	for _, entry := range p.index.Entries() {
+		if entry.Object.Accessed > cutoff.Unix() {
+			continue
+		}
+
+		_, err := os.Stat(p.GetFilePath(entry.Identifier))
+		if os.IsNotExist(err) {
+			log.Printf("Removing index record for missing object %v.", entry.Identifier)
+			report.MissingFiles++
+			if err := p.Delete(context.Background(), entry.Identifier); err != nil {
+				report.Errors++
+			}
+		}
+	}
+
+	//  Temporary files left behind by abandoned writes.
+	temps, err := ioutil.ReadDir(p.GetTempPath())
+	if err != nil {
+		report.Errors++
+	}
+	for _, info := range temps {
+		if info.Mode().IsRegular() && info.ModTime().Before(cutoff) {
+			if err := os.Remove(p.GetTempPath() + info.Name()); err != nil {
+				report.Errors++
+			} else {
+				report.TempFiles++
+				report.OrphanedBytes += info.Size()
+			}
+		}
+	}
+
+	report.Finished = time.Now().Unix()
+	log.Printf("Finished scrubbing %v: %+v", p, *report)
+	return report
+}
+
+// DiscardCorrupt moves an object into the quarantine directory (or deletes
+// it, depending on scrub_action) and drops it from the cache.
+func (p *FileProvider) DiscardCorrupt(id string) error {
+	if p.GetConfig().ScrubAction == "quarantine" {
+		err := os.MkdirAll(p.GetQuarantinePath(""), os.ModeDir|os.ModePerm)
+		if err != nil {
+			return err
+		}
+
+		err = os.Rename(p.GetFilePath(id), p.GetQuarantinePath(id))
+		if err != nil {
+			return err
+		}
+	}
+	return p.Delete(context.Background(), id)
+}
+
+func (p *FileProvider) GetQuarantinePath(id string) string {
+	return p.GetConfig().Path + "/quarantine/" + id
+}
+
+// objectDigests returns the MD5 digest and SHA-256 checksum of an object's
+// contents, decrypting and decompressing it as necessary. An object that
+// can't be decrypted or decompressed is corrupt, and has empty digests.
+func (p *FileProvider) objectDigests(id string, path string, bo BaseObject) (string, string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", "", err
+	}
+	defer file.Close()
+
+	bo.identifier = id
+	o, err := p.Decrypt(&FileObject{BaseObject: bo, File: file})
+	if err == ErrUnknownEncryptionKey {
+		return "", "", err
+	} else if err != nil {
+		return "", "", nil
+	}
+
+	//  An encrypted object's encoding is only known once it's decrypted.
+	var reader io.Reader = o
+	transformed := IsEncrypted(bo)
+	if encoding := o.GetBaseObject().Encoding; len(encoding) > 0 {
+		decoder, err := NewDecoder(encoding, o)
+		if err == ErrUnknownEncoding {
+			return "", "", err
+		} else if err != nil {
+			return "", "", nil
+		}
+		defer decoder.Close()
+		reader = decoder
+		transformed = true
+	}
+
+	digest := md5.New()
+	checksum := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(digest, checksum), reader); err != nil {
+		if transformed {
+			return "", "", nil
+		}
+		return "", "", err
+	}
+	return hex.EncodeToString(digest.Sum(nil)), hex.EncodeToString(checksum.Sum(nil)), nil
+}
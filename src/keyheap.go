@@ -0,0 +1,99 @@
+package main
+
+import (
+	"container/heap"
+)
+
+/*
+ *  KeyHeap is an indexed min-heap of string keys by int64 priority.
+ *  Inserting, updating and removing a key are all O(log n), and the key
+ *  with the lowest priority can be found in O(1).
+ */
+
+type KeyHeap struct {
+	items keyHeapItems
+	index map[string]*keyHeapItem
+}
+
+type keyHeapItem struct {
+	key      string
+	priority int64
+	position int
+}
+
+type keyHeapItems []*keyHeapItem
+
+func NewKeyHeap() *KeyHeap {
+	return &KeyHeap{
+		items: make(keyHeapItems, 0),
+		index: make(map[string]*keyHeapItem),
+	}
+}
+
+func (h *KeyHeap) Len() int {
+	return len(h.items)
+}
+
+// Set inserts key, or moves it if it's already in the heap.
+func (h *KeyHeap) Set(key string, priority int64) {
+	if item, ok := h.index[key]; ok {
+		item.priority = priority
+		heap.Fix(&h.items, item.position)
+	} else {
+		item := &keyHeapItem{key: key, priority: priority}
+		h.index[key] = item
+		heap.Push(&h.items, item)
+	}
+}
+
+func (h *KeyHeap) Get(key string) (int64, bool) {
+	if item, ok := h.index[key]; ok {
+		return item.priority, true
+	} else {
+		return 0, false
+	}
+}
+
+func (h *KeyHeap) Remove(key string) {
+	if item, ok := h.index[key]; ok {
+		heap.Remove(&h.items, item.position)
+		delete(h.index, key)
+	}
+}
+
+// Peek returns the key with the lowest priority without removing it.
+func (h *KeyHeap) Peek() (string, int64, bool) {
+	if len(h.items) == 0 {
+		return "", 0, false
+	} else {
+		return h.items[0].key, h.items[0].priority, true
+	}
+}
+
+func (items keyHeapItems) Len() int {
+	return len(items)
+}
+
+func (items keyHeapItems) Less(i, j int) bool {
+	return items[i].priority < items[j].priority
+}
+
+func (items keyHeapItems) Swap(i, j int) {
+	items[i], items[j] = items[j], items[i]
+	items[i].position = i
+	items[j].position = j
+}
+
+func (items *keyHeapItems) Push(x interface{}) {
+	item := x.(*keyHeapItem)
+	item.position = len(*items)
+	*items = append(*items, item)
+}
+
+func (items *keyHeapItems) Pop() interface{} {
+	old := *items
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*items = old[0 : len(old)-1]
+	return item
+}
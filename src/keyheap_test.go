@@ -0,0 +1,90 @@
+package main
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+// The numbers of keys each benchmark is run against. Each operation
+// should cost about the same at every size.
+var keyHeapSizes = []int{1000, 10000, 100000, 500000}
+
+func newBenchmarkKeyHeap(size int) (*KeyHeap, []string) {
+	h := NewKeyHeap()
+	keys := make([]string, size)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+		h.Set(keys[i], rand.Int63n(1<<40))
+	}
+	return h, keys
+}
+
+func TestKeyHeapOrder(t *testing.T) {
+	h, keys := newBenchmarkKeyHeap(1000)
+	h.Set(keys[10], -1)
+	h.Remove(keys[20])
+	if key, priority, _ := h.Peek(); key != keys[10] || priority != -1 {
+		t.Fatalf("Peek() = %v, %v; want %v, -1", key, priority, keys[10])
+	}
+
+	last := int64(-2)
+	for h.Len() > 0 {
+		key, priority, _ := h.Peek()
+		if priority < last {
+			t.Fatalf("%v came out with priority %v after %v", key, priority, last)
+		}
+		last = priority
+		h.Remove(key)
+	}
+	if _, ok := h.Get(keys[10]); ok {
+		t.Fatal("Removed key is still in the heap.")
+	}
+}
+
+func BenchmarkKeyHeapPush(b *testing.B) {
+	for _, size := range keyHeapSizes {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			h, _ := newBenchmarkKeyHeap(size)
+			keys := make([]string, b.N)
+			for i := range keys {
+				keys[i] = "new-" + strconv.Itoa(i)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				h.Set(keys[i], rand.Int63n(1<<40))
+			}
+		})
+	}
+}
+
+func BenchmarkKeyHeapUpdate(b *testing.B) {
+	for _, size := range keyHeapSizes {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			h, keys := newBenchmarkKeyHeap(size)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				h.Set(keys[rand.Intn(size)], rand.Int63n(1<<40))
+			}
+		})
+	}
+}
+
+// Each pop is followed by a push of the same key with a later priority, as
+// when an evicted object is replaced, so that the heap stays the same size.
+func BenchmarkKeyHeapPop(b *testing.B) {
+	for _, size := range keyHeapSizes {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			h, _ := newBenchmarkKeyHeap(size)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				key, priority, _ := h.Peek()
+				h.Remove(key)
+				h.Set(key, priority+rand.Int63n(1<<32))
+			}
+		})
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ *  Logging. Every line is a JSON object with the time, level, source location
+ *  and message, along with any fields attached to the logger that wrote it -
+ *  most importantly the request_id of the HTTP request it was written on
+ *  behalf of. Lines written with the standard log package are logged at info
+ *  level.
+ *
+ *  Each incoming request is given an ID (or keeps the X-Till-Request-ID it
+ *  arrived with, if it came from another Till server), which is carried in
+ *  the request's context to every provider, and passed on to other Till
+ *  servers in the same header.
+ */
+
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func ParseLogLevel(name string) (LogLevel, bool) {
+	for i, n := range logLevelNames {
+		if n == name {
+			return LogLevel(i), true
+		}
+	}
+	return LevelInfo, false
+}
+
+func (l LogLevel) String() string {
+	return logLevelNames[l]
+}
+
+var logOutput = struct {
+	sync.Mutex
+	writer io.Writer
+	level  LogLevel
+}{writer: os.Stderr, level: LevelInfo}
+
+func SetLogOutput(writer io.Writer) {
+	logOutput.Lock()
+	defer logOutput.Unlock()
+	logOutput.writer = writer
+}
+
+func SetLogLevel(level LogLevel) {
+	logOutput.Lock()
+	defer logOutput.Unlock()
+	logOutput.level = level
+}
+
+type logField struct {
+	key   string
+	value interface{}
+}
+
+type Logger struct {
+	fields []logField
+}
+
+// Log is the root logger, with no fields of its own.
+var Log = &Logger{}
+
+// With returns a logger that adds key to every line it writes.
+func (l *Logger) With(key string, value interface{}) *Logger {
+	fields := make([]logField, len(l.fields), len(l.fields)+1)
+	copy(fields, l.fields)
+	return &Logger{fields: append(fields, logField{key, value})}
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.write(LevelDebug, callerOf(2), fmt.Sprintf(format, args...), nil)
+}
+
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.write(LevelInfo, callerOf(2), fmt.Sprintf(format, args...), nil)
+}
+
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.write(LevelWarn, callerOf(2), fmt.Sprintf(format, args...), nil)
+}
+
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.write(LevelError, callerOf(2), fmt.Sprintf(format, args...), nil)
+}
+
+func callerOf(depth int) string {
+	_, file, line, ok := runtime.Caller(depth)
+	if !ok {
+		return ""
+	}
+	return filepath.Base(file) + ":" + fmt.Sprint(line)
+}
+
+func (l *Logger) write(level LogLevel, caller string, message string, extra []logField) {
+	logOutput.Lock()
+	defer logOutput.Unlock()
+	if level < logOutput.level {
+		return
+	}
+
+	var line bytes.Buffer
+	line.WriteString("{")
+	writeLogField(&line, "time", time.Now().UTC().Format(time.RFC3339Nano), true)
+	writeLogField(&line, "level", level.String(), false)
+	writeLogField(&line, "pid", os.Getpid(), false)
+	if len(caller) > 0 {
+		writeLogField(&line, "caller", caller, false)
+	}
+	writeLogField(&line, "msg", message, false)
+	for _, field := range l.fields {
+		writeLogField(&line, field.key, field.value, false)
+	}
+	for _, field := range extra {
+		writeLogField(&line, field.key, field.value, false)
+	}
+	line.WriteString("}\n")
+
+	logOutput.writer.Write(line.Bytes())
+}
+
+func writeLogField(line *bytes.Buffer, key string, value interface{}, first bool) {
+	if err, ok := value.(error); ok {
+		value = err.Error()
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		encoded, _ = json.Marshal(fmt.Sprint(value))
+	}
+	name, _ := json.Marshal(key)
+
+	if !first {
+		line.WriteString(",")
+	}
+	line.Write(name)
+	line.WriteString(":")
+	line.Write(encoded)
+}
+
+// StdLogWriter receives lines from the standard log package, which must be
+// set up with log.Lshortfile and no other flags or prefix.
+type StdLogWriter struct{}
+
+var stdLogCaller = regexp.MustCompile(`^([^ :]+\.go:[0-9]+): `)
+
+func (w StdLogWriter) Write(data []byte) (int, error) {
+	message := strings.TrimRight(string(data), "\n")
+	caller := ""
+	if match := stdLogCaller.FindStringSubmatch(message); match != nil {
+		caller = match[1]
+		message = message[len(match[0]):]
+	}
+	Log.write(LevelInfo, caller, message, nil)
+	return len(data), nil
+}
+
+/*
+ *  Request context.
+ */
+
+type requestContextKey struct{}
+
+type RequestInfo struct {
+	ID  string
+	Log *Logger
+
+	//  The provider whose answer was used, for the access log.
+	Provider string
+}
+
+var requestIDPattern = regexp.MustCompile("^[a-zA-Z0-9_\\-.]{1,64}$")
+
+func NewRequestID() string {
+	data := make([]byte, 8)
+	rand.Read(data)
+	return hex.EncodeToString(data)
+}
+
+func WithRequestInfo(ctx context.Context, info *RequestInfo) context.Context {
+	return context.WithValue(ctx, requestContextKey{}, info)
+}
+
+// GetRequestInfo returns the request that ctx belongs to, or nil if it
+// doesn't belong to one.
+func GetRequestInfo(ctx context.Context) *RequestInfo {
+	info, _ := ctx.Value(requestContextKey{}).(*RequestInfo)
+	return info
+}
+
+// LogFor returns the logger for the request that ctx belongs to, or the root
+// logger.
+func LogFor(ctx context.Context) *Logger {
+	if info := GetRequestInfo(ctx); info != nil {
+		return info.Log
+	}
+	return Log
+}
+
+// DetachedContext returns a context for work that carries on after its
+// request has finished, such as a backfill. It keeps the request's ID and
+// trace.
+func DetachedContext(ctx context.Context) context.Context {
+	detached := context.Background()
+	if info := GetRequestInfo(ctx); info != nil {
+		detached = WithRequestInfo(detached, info)
+	}
+	if c, ok := SpanContextFrom(ctx); ok {
+		detached = withSpanContext(detached, c)
+	}
+	return detached
+}
+
+// SetAnsweringProvider records the provider whose answer was used for a
+// request.
+func SetAnsweringProvider(r *http.Request, p Provider) {
+	if info := GetRequestInfo(r.Context()); info != nil {
+		info.Provider = p.Name()
+	}
+}
+
+// PropagateRequestID passes the ID of ctx's request on to another Till server.
+func PropagateRequestID(ctx context.Context, req *http.Request) {
+	if info := GetRequestInfo(ctx); info != nil {
+		req.Header.Set("X-Till-Request-ID", info.ID)
+	}
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+
+	status  int
+	written int64
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = 200
+	}
+	length, err := w.ResponseWriter.Write(data)
+	w.written += int64(length)
+	return length, err
+}
+
+// LogRequests gives every request an ID, and writes an access log line for
+// it once it has been answered.
+func LogRequests(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+
+		id := r.Header.Get("X-Till-Request-ID")
+		if !requestIDPattern.MatchString(id) {
+			id = NewRequestID()
+		}
+		info := &RequestInfo{ID: id, Log: Log.With("request_id", id)}
+		r = r.WithContext(WithRequestInfo(r.Context(), info))
+
+		writer.Header().Set("X-Till-Request-ID", id)
+		recorder := &statusRecorder{ResponseWriter: writer}
+
+		defer func() {
+			aborted := recover()
+
+			status := recorder.status
+			if status == 0 {
+				status = 200
+			}
+			fields := []logField{
+				{"method", r.Method},
+				{"path", r.URL.Path},
+				{"remote", r.RemoteAddr},
+				{"status", status},
+				{"bytes", recorder.written},
+				{"latency_ms", float64(time.Since(started)) / float64(time.Millisecond)},
+			}
+			if len(info.Provider) > 0 {
+				fields = append(fields, logField{"provider", info.Provider})
+			}
+			if aborted != nil {
+				fields = append(fields, logField{"aborted", true})
+			}
+			info.Log.write(LevelInfo, "", "request", fields)
+
+			if aborted != nil {
+				panic(aborted)
+			}
+		}()
+
+		handler.ServeHTTP(recorder, r)
+	})
+}
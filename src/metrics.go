@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+ *  /metrics serves each provider's counters and usage in the Prometheus text
+ *  exposition format. Everything is read at scrape time from the same
+ *  ProviderCounters that back /api/v1/stats.
+ */
+
+type CountingResponseWriter struct {
+	http.ResponseWriter
+
+	written int64
+}
+
+func (w *CountingResponseWriter) Write(data []byte) (int, error) {
+	length, err := w.ResponseWriter.Write(data)
+	w.written += int64(length)
+	return length, err
+}
+
+type metricsWriter struct {
+	bytes.Buffer
+}
+
+func (m *metricsWriter) header(name string, kind string, help string) {
+	fmt.Fprintf(m, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes one value, with labels given as alternating names and values.
+func (m *metricsWriter) sample(name string, value float64, labels ...string) {
+	m.WriteString(name)
+	if len(labels) > 0 {
+		m.WriteString("{")
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				m.WriteString(",")
+			}
+			m.WriteString(labels[i] + "=\"" + escapeLabel(labels[i+1]) + "\"")
+		}
+		m.WriteString("}")
+	}
+	m.WriteString(" " + strconv.FormatFloat(value, 'g', -1, 64) + "\n")
+}
+
+var labelEscaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+func isLookup(operation string) bool {
+	return operation == OpGet || operation == OpStat || operation == OpGetURL
+}
+
+type providerSnapshot struct {
+	name        string
+	usage       ProviderUsage
+	operations  map[string]OperationCounters
+	evictions   int64
+	expirations int64
+	circuit     CircuitStats
+}
+
+// sortedOperations returns the names of a snapshot's operations, so that the
+// output is stable from one scrape to the next.
+func (s *providerSnapshot) sortedOperations() []string {
+	names := make([]string, 0, len(s.operations))
+	for name := range s.operations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func WriteMetrics(m *metricsWriter) {
+	names := make([]string, 0, len(state.Providers))
+	for name := range state.Providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	snapshots := make([]*providerSnapshot, 0, len(names))
+	for _, name := range names {
+		p := state.Providers[name]
+		operations, evictions, expirations := p.Counters().Snapshot()
+		snapshots = append(snapshots, &providerSnapshot{
+			name:        name,
+			usage:       p.Usage(),
+			operations:  operations,
+			evictions:   evictions,
+			expirations: expirations,
+			circuit:     p.Breaker().Stats(),
+		})
+	}
+
+	m.header("till_provider_requests_total", "counter", "Requests made to each provider, by operation and outcome.")
+	for _, s := range snapshots {
+		for _, name := range s.sortedOperations() {
+			op := s.operations[name]
+			if isLookup(name) {
+				m.sample("till_provider_requests_total", float64(op.Hits), "provider", s.name, "operation", name, "status", "hit")
+				m.sample("till_provider_requests_total", float64(op.Misses), "provider", s.name, "operation", name, "status", "miss")
+			} else {
+				m.sample("till_provider_requests_total", float64(op.Successes), "provider", s.name, "operation", name, "status", "ok")
+			}
+			m.sample("till_provider_requests_total", float64(op.Errors), "provider", s.name, "operation", name, "status", "error")
+			m.sample("till_provider_requests_total", float64(op.Timeouts), "provider", s.name, "operation", name, "status", "timeout")
+		}
+	}
+
+	m.header("till_provider_request_duration_seconds", "histogram", "Time taken by each provider to answer requests, by operation.")
+	for _, s := range snapshots {
+		for _, name := range s.sortedOperations() {
+			op := s.operations[name]
+			cumulative := int64(0)
+			for i, bound := range LatencyBuckets {
+				cumulative += op.Buckets[i]
+				m.sample("till_provider_request_duration_seconds_bucket", float64(cumulative), "provider", s.name, "operation", name, "le", strconv.FormatFloat(bound, 'g', -1, 64))
+			}
+			m.sample("till_provider_request_duration_seconds_bucket", float64(op.Count), "provider", s.name, "operation", name, "le", "+Inf")
+			m.sample("till_provider_request_duration_seconds_sum", op.Sum, "provider", s.name, "operation", name)
+			m.sample("till_provider_request_duration_seconds_count", float64(op.Count), "provider", s.name, "operation", name)
+		}
+	}
+
+	m.header("till_provider_received_bytes_total", "counter", "Bytes of object data stored in each provider.")
+	for _, s := range snapshots {
+		if op, ok := s.operations[OpPut]; ok {
+			m.sample("till_provider_received_bytes_total", float64(op.Bytes), "provider", s.name, "operation", OpPut)
+		}
+	}
+
+	m.header("till_provider_sent_bytes_total", "counter", "Bytes of object data served to clients from each provider.")
+	for _, s := range snapshots {
+		if op, ok := s.operations[OpGet]; ok {
+			m.sample("till_provider_sent_bytes_total", float64(op.Bytes), "provider", s.name, "operation", OpGet)
+		}
+	}
+
+	m.header("till_provider_evictions_total", "counter", "Objects evicted (or demoted) from each provider to stay within its limits.")
+	for _, s := range snapshots {
+		m.sample("till_provider_evictions_total", float64(s.evictions), "provider", s.name)
+	}
+
+	m.header("till_provider_expirations_total", "counter", "Objects removed from each provider once their lifespan ran out.")
+	for _, s := range snapshots {
+		m.sample("till_provider_expirations_total", float64(s.expirations), "provider", s.name)
+	}
+
+	m.header("till_provider_healthy", "gauge", "Whether each provider is reachable (1) or not (0).")
+	for _, s := range snapshots {
+		healthy := 0.0
+		if s.usage.Healthy {
+			healthy = 1
+		}
+		m.sample("till_provider_healthy", healthy, "provider", s.name)
+	}
+
+	m.header("till_provider_circuit_open", "gauge", "Whether requests are skipping each provider (1) or not (0).")
+	for _, s := range snapshots {
+		open := 0.0
+		if s.circuit.State == CircuitOpen {
+			open = 1
+		}
+		m.sample("till_provider_circuit_open", open, "provider", s.name)
+	}
+
+	m.header("till_provider_circuit_opened_total", "counter", "Times each provider's circuit has opened.")
+	for _, s := range snapshots {
+		m.sample("till_provider_circuit_opened_total", float64(s.circuit.Opened), "provider", s.name)
+	}
+
+	m.header("till_provider_objects", "gauge", "Objects held by each provider, for providers that know.")
+	for _, s := range snapshots {
+		if s.usage.Items >= 0 {
+			m.sample("till_provider_objects", float64(s.usage.Items), "provider", s.name)
+		}
+	}
+
+	m.header("till_provider_bytes", "gauge", "Bytes held by each provider, for providers that know.")
+	for _, s := range snapshots {
+		if s.usage.Bytes >= 0 {
+			m.sample("till_provider_bytes", float64(s.usage.Bytes), "provider", s.name)
+		}
+	}
+
+	state.metadataMutex.RLock()
+	servers := len(state.Servers)
+	state.metadataMutex.RUnlock()
+
+	m.header("till_cluster_servers", "gauge", "Other Till servers known to this one.")
+	m.sample("till_cluster_servers", float64(servers))
+}
+
+func MetricsEndpoint(writer http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(writer, "Method not allowed.", 405)
+		return
+	}
+
+	m := &metricsWriter{}
+	WriteMetrics(m)
+	writer.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writer.Write(m.Bytes())
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"errors"
 	"io"
+	"time"
 )
 
 type Object interface {
@@ -14,14 +15,30 @@ type Object interface {
 	Close() error
 }
 
+// Objects that can be read from an arbitrary offset (for Range requests)
+// implement SeekableObject as well.
+type SeekableObject interface {
+	Object
+	Seek(offset int64, whence int) (int64, error)
+}
+
 type BaseObject struct {
 	// JSON-Serializable (a.k.a: stored on disk) metadata
 	Expires  int64  `json:"expires"`
 	Metadata string `json:"metadata"`
+	ETag     string `json:"etag"`
+	Checksum string `json:"checksum"`
+
+	//  How the stored object is compressed, if at all, and its size before
+	//  compression.
+	Encoding    string `json:"encoding"`
+	DecodedSize int64  `json:"decoded_size"`
 
 	identifier string
 	exists     bool
 	provider   Provider
+	url        string
+	modified   time.Time
 }
 
 func (b BaseObject) GetBaseObject() BaseObject {
@@ -29,11 +46,10 @@ func (b BaseObject) GetBaseObject() BaseObject {
 }
 
 func (b *BaseObject) URL() *string {
-	if b.provider == nil {
+	if b.provider == nil || len(b.url) == 0 {
 		return nil
 	} else {
-		//  TODO
-		return nil
+		return &b.url
 	}
 }
 
@@ -58,15 +74,105 @@ type UploadObject struct {
 	size   int64
 }
 
+func (b *UploadObject) GetBaseObject() BaseObject {
+	//  The ETag and checksum of an upload are only known once it's been
+	//  completely read.
+	bo := b.BaseObject
+	if fr, ok := b.reader.(*FanOutReader); ok {
+		bo.ETag = fr.fanout.Digest()
+		bo.Checksum = fr.fanout.Checksum()
+	}
+	return bo
+}
+
 func (b *UploadObject) GetSize() (int64, error) {
+	if b.size < 0 {
+		//  Chunked uploads don't know their size until they've been read.
+		if fr, ok := b.reader.(*FanOutReader); ok {
+			return fr.Size()
+		}
+	}
 	return b.size, nil
 }
 
+// ContentLength returns o's size if it's known without reading o, and -1
+// otherwise.
+func ContentLength(o Object) (int64, error) {
+	if u, ok := o.(*UploadObject); ok && u.size < 0 {
+		return -1, nil
+	}
+	return o.GetSize()
+}
+
+// ReceiveUpload waits until o, if it's an upload still being received from
+// the client, has been received in full, so that its ETag and checksum are
+// known before it's stored. The body is buffered by the fan-out meanwhile.
+func ReceiveUpload(o Object) error {
+	if u, ok := o.(*UploadObject); ok {
+		if fr, ok := u.reader.(*FanOutReader); ok {
+			_, err := fr.Size()
+			return err
+		}
+	}
+	return nil
+}
+
 func (b *UploadObject) Read(by []byte) (int, error) {
 	length, err := b.reader.Read(by)
 	return length, err
 }
 
+// Close closes the body, if there is one; updates don't have a body.
 func (b *UploadObject) Close() error {
+	if b.reader == nil {
+		return nil
+	}
 	return b.reader.Close()
 }
+
+// A URLObject is returned by GetURL, and only knows where an object is.
+type URLObject struct {
+	BaseObject
+}
+
+func NewURLObject(id string, url string, provider Provider) *URLObject {
+	return &URLObject{
+		BaseObject: BaseObject{
+			identifier: id,
+			exists:     true,
+			provider:   provider,
+			url:        url,
+		},
+	}
+}
+
+func (u *URLObject) GetSize() (int64, error) {
+	return -1, nil
+}
+
+func (u *URLObject) Read(by []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (u *URLObject) Close() error {
+	return nil
+}
+
+// A StatObject is returned by Stat, and knows everything but an object's contents.
+type StatObject struct {
+	BaseObject
+
+	size int64
+}
+
+func (s *StatObject) GetSize() (int64, error) {
+	return s.size, nil
+}
+
+func (s *StatObject) Read(by []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (s *StatObject) Close() error {
+	return nil
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"log"
+	"time"
 )
 
 type Provider interface {
@@ -12,6 +15,12 @@ type Provider interface {
 	OnServerUp()
 
 	//  API Methods
+	//      Each of these methods takes the context of the request it's
+	//      made on behalf of. It's cancelled once the request no longer
+	//      needs the answer (another provider won the race, or a timeout
+	//      passed), and providers should give up on their work when it
+	//      is. An object that's returned may go on reading with the same
+	//      context, so it must not be cancelled until the object is closed.
 	//      The return values of each of these methods:
 	//          *Object is:
 	//              a pointer to the object returned
@@ -21,18 +30,82 @@ type Provider interface {
 	//              non-nil if the request could not be completed
 	//              (nil if the request completed, but the object was not found)
 
-	Get(id string) (Object, error)
-	GetURL(id string) (Object, error)
+	Get(ctx context.Context, id string) (Object, error)
 
-	Put(object Object) (Object, error)
-	Update(object Object) (Object, error)
+	//      Stat returns an object with no body, for checking existence,
+	//      size and metadata without fetching the object itself.
+	Stat(ctx context.Context, id string) (Object, error)
+
+	//      GetURL returns an object whose URL() is valid until at least expires.
+	GetURL(ctx context.Context, id string, expires time.Time) (Object, error)
+
+	Put(ctx context.Context, object Object) (Object, error)
+	Update(ctx context.Context, object Object) (Object, error)
+
+	//      Delete returns nil if the object was removed or did not exist.
+	Delete(ctx context.Context, id string) error
 
 	Name() string
 	AcceptsKey(key string) bool
+
+	//  Providers that objects served by this provider are copied into.
+	PromoteTo() []string
+
+	//  Whether objects must be stored under the SHA-256 of their contents.
+	ContentAddressed() bool
+
+	//  The read tier the provider belongs to (see ReadTiers), and how long
+	//  to wait for that tier before starting the next; -1 if not configured.
+	Tier() string
+	HedgeDelay() time.Duration
+
+	//  How long a single request of the given operation may take; 0 if only
+	//  the request-wide timeout applies.
+	Timeout(operation string) time.Duration
+
+	//  Tracks consecutive failures, so that requests can skip the provider
+	//  while it's down.
+	Breaker() *CircuitBreaker
+
+	//  For /api/v1/stats: the provider's type, the outcome of requests made
+	//  to it, and what it currently holds.
+	Type() string
+	Counters() *ProviderCounters
+	Usage() ProviderUsage
+}
+
+// GetTargetProviders resolves a list of provider names (from promote_to or
+// demote_to) to the providers that should receive the object with this id.
+func GetTargetProviders(id string, source Provider, names []string) []Provider {
+	targets := make([]Provider, 0)
+	for _, name := range names {
+		if name == source.Name() {
+			continue
+		}
+
+		if p, ok := state.Providers[name]; ok {
+			if p.AcceptsKey(id) {
+				targets = append(targets, p)
+			}
+		} else {
+			log.Printf("Provider \"%v\" named by \"%v\" not found.", name, source.Name())
+		}
+	}
+	return targets
 }
 
 type BaseProvider struct {
-	config ProviderConfig
+	config   ProviderConfig
+	counters *ProviderCounters
+	breaker  *CircuitBreaker
+}
+
+func NewBaseProvider(config ProviderConfig) BaseProvider {
+	return BaseProvider{
+		config:   config,
+		counters: NewProviderCounters(),
+		breaker:  NewCircuitBreaker(config.CircuitBreaker()),
+	}
 }
 
 func (b *BaseProvider) String() string {
@@ -63,6 +136,58 @@ func (b *BaseProvider) Name() string {
 	return b.config.Name()
 }
 
+func (b *BaseProvider) PromoteTo() []string {
+	return b.config.PromoteTo()
+}
+
+func (b *BaseProvider) ContentAddressed() bool {
+	return b.config.ContentAddressed()
+}
+
+func (b *BaseProvider) Tier() string {
+	return b.config.Tier()
+}
+
+func (b *BaseProvider) HedgeDelay() time.Duration {
+	return b.config.HedgeDelay()
+}
+
+func (b *BaseProvider) Timeout(operation string) time.Duration {
+	return b.config.Timeout(operation)
+}
+
+func (b *BaseProvider) Breaker() *CircuitBreaker {
+	return b.breaker
+}
+
+func (b *BaseProvider) Type() string {
+	return b.config.Type()
+}
+
+func (b *BaseProvider) Counters() *ProviderCounters {
+	return b.counters
+}
+
+// Usage is healthy unless the last request to the provider failed; the
+// provider's contents and limits are unknown.
+func (b *BaseProvider) Usage() ProviderUsage {
+	err := b.counters.LastError()
+	return ProviderUsage{
+		Healthy: len(err) == 0,
+		Error:   err,
+		Items:   -1,
+		Bytes:   -1,
+	}
+}
+
+// LocalURL returns a URL that fetches the object through this tilld.
+func (b *BaseProvider) LocalURL(id string) (string, error) {
+	if len(state.Config.PublicAddress) == 0 {
+		return "", errors.New("public_address must be configured to generate URLs.")
+	}
+	return "http://" + state.Config.PublicAddress + "/api/v1/object/" + id, nil
+}
+
 func (b *BaseProvider) CanAccept(object Object) (bool, error) {
 	panic(errors.New("CanAccept not implemented on BaseProvider."))
 	return false, errors.New("CanAccept not implemented.")
@@ -1,10 +1,10 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"errors"
 	"github.com/ncw/swift"
-	"io"
+	"net/http"
 	"strconv"
 	"time"
 )
@@ -12,11 +12,12 @@ import (
 type RackspaceProviderConfig struct {
 	BaseProviderConfig
 
-	RackspaceUserName  string `json:"rackspace_user_name"`
-	RackspaceAPIKey    string `json:"rackspace_api_key"`
-	RackspaceContainer string `json:"rackspace_container"`
-	RackspaceRegion    string `json:"rackspace_region"`
-	RackspacePrefix    string `json:"rackspace_prefix"`
+	RackspaceUserName   string `json:"rackspace_user_name"`
+	RackspaceAPIKey     string `json:"rackspace_api_key"`
+	RackspaceContainer  string `json:"rackspace_container"`
+	RackspaceRegion     string `json:"rackspace_region"`
+	RackspacePrefix     string `json:"rackspace_prefix"`
+	RackspaceTempURLKey string `json:"rackspace_temp_url_key"`
 }
 
 func NewRackspaceProviderConfig(base BaseProviderConfig, data map[string]interface{}) (*RackspaceProviderConfig, error) {
@@ -74,6 +75,16 @@ func NewRackspaceProviderConfig(base BaseProviderConfig, data map[string]interfa
 		config.RackspacePrefix = ""
 	}
 
+	temp_url_key, ok := data["rackspace_temp_url_key"]
+	if ok {
+		config.RackspaceTempURLKey, ok = temp_url_key.(string)
+		if !ok {
+			return nil, errors.New("rackspace_temp_url_key must be a string.")
+		}
+	} else {
+		config.RackspaceTempURLKey = ""
+	}
+
 	return &config, nil
 }
 
@@ -89,7 +100,7 @@ func (p *RackspaceProvider) GetConfig() RackspaceProviderConfig {
 
 func (c RackspaceProviderConfig) NewProvider() (Provider, error) {
 	r := &RackspaceProvider{
-		BaseProvider: BaseProvider{c},
+		BaseProvider: NewBaseProvider(c),
 	}
 
 	r.conn = swift.Connection{
@@ -109,28 +120,29 @@ func (c RackspaceProviderConfig) NewProvider() (Provider, error) {
 type RackspaceObject struct {
 	BaseObject
 
-	size   int64
-	reader io.ReadCloser
+	file *swift.ObjectOpenFile
 }
 
 func (s *RackspaceObject) GetSize() (int64, error) {
-	return s.size, nil
+	return s.file.Length()
 }
 
 func (s *RackspaceObject) Read(buf []byte) (int, error) {
-	return s.reader.Read(buf)
+	return s.file.Read(buf)
+}
+
+func (s *RackspaceObject) Seek(offset int64, whence int) (int64, error) {
+	return s.file.Seek(offset, whence)
 }
 
 func (s *RackspaceObject) Close() error {
-	return s.reader.Close()
+	return s.file.Close()
 }
 
-func (p *RackspaceProvider) Get(id string) (Object, error) {
+func (p *RackspaceProvider) Get(ctx context.Context, id string) (Object, error) {
 	path := id
 
-	var buf bytes.Buffer
-	headers, err := p.conn.ObjectGet(p.container.Name, p.GetConfig().RackspacePrefix+path, &buf, true, nil)
-	rc := NewDummyReadCloser(&buf)
+	file, headers, err := p.conn.ObjectOpen(p.container.Name, p.GetConfig().RackspacePrefix+path, false, nil)
 
 	if err == swift.ObjectNotFound {
 		return nil, nil
@@ -138,28 +150,106 @@ func (p *RackspaceProvider) Get(id string) (Object, error) {
 		return nil, err
 	} else {
 		md, _ := headers["X-Object-Meta-Till"]
+		modified, _ := http.ParseTime(headers["Last-Modified"])
+		expires, _ := strconv.ParseInt(headers["X-Delete-At"], 10, 64)
+
+		bo := BaseObject{
+			Expires:    expires,
+			Metadata:   md,
+			ETag:       headers["Etag"],
+			Checksum:   headers["X-Object-Meta-Till-Checksum"],
+			identifier: id,
+			exists:     true,
+			provider:   p,
+			modified:   modified,
+		}
+		ParseEncoding(headers["X-Object-Meta-Till-Encoding"], &bo)
+		DiscardStoredETag(&bo)
 
-		return &RackspaceObject{
-			BaseObject: BaseObject{
-				Metadata:   md,
-				identifier: id,
-				exists:     true,
-				provider:   p,
-			},
-			reader: &rc,
-			size:   int64(buf.Len()),
-		}, nil
+		return p.Decrypt(&RackspaceObject{
+			BaseObject: bo,
+			file:       file,
+		})
 	}
 }
 
-func (p *RackspaceProvider) GetURL(id string) (Object, error) {
-	//	TODO: Add GetURL support.
-	return nil, nil
+func (p *RackspaceProvider) Stat(ctx context.Context, id string) (Object, error) {
+	info, headers, err := p.conn.Object(p.container.Name, p.GetConfig().RackspacePrefix+id)
+
+	if err == swift.ObjectNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	} else {
+		expires, _ := strconv.ParseInt(headers["X-Delete-At"], 10, 64)
+
+		bo := BaseObject{
+			Expires:    expires,
+			Metadata:   headers["X-Object-Meta-Till"],
+			ETag:       info.Hash,
+			Checksum:   headers["X-Object-Meta-Till-Checksum"],
+			identifier: id,
+			exists:     true,
+			provider:   p,
+			modified:   info.LastModified,
+		}
+		ParseEncoding(headers["X-Object-Meta-Till-Encoding"], &bo)
+		DiscardStoredETag(&bo)
+
+		return p.Decrypt(&StatObject{
+			BaseObject: bo,
+			size:       info.Bytes,
+		})
+	}
+}
+
+func (p *RackspaceProvider) GetURL(ctx context.Context, id string, expires time.Time) (Object, error) {
+	key := p.GetConfig().RackspaceTempURLKey
+	if len(key) == 0 {
+		return nil, errors.New("rackspace_temp_url_key must be defined to generate URLs.")
+	}
+
+	path := p.GetConfig().RackspacePrefix + id
+	_, headers, err := p.conn.Object(p.container.Name, path)
+	if err == swift.ObjectNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	} else if p.Encrypts() || len(headers["X-Object-Meta-Till-Encoding"]) > 0 {
+		//	Rackspace would serve the object as it's stored, so send
+		//	clients through tilld instead.
+		url, err := p.LocalURL(id)
+		if err != nil {
+			return nil, err
+		}
+		return NewURLObject(id, url, p), nil
+	} else {
+		url := p.conn.ObjectTempUrl(p.container.Name, path, key, "GET", expires)
+		return NewURLObject(id, url, p), nil
+	}
 }
 
-func (p *RackspaceProvider) Put(o Object) (Object, error) {
+func (p *RackspaceProvider) Put(ctx context.Context, o Object) (Object, error) {
 	//	TODO: Add path support within the container?
 
+	//	The checksum is stored as metadata, and Swift checks the object
+	//	against its MD5 digest, so both must be known before it's sent.
+	err := ReceiveUpload(o)
+	if err != nil {
+		return nil, err
+	}
+
+	o, err = p.CompressSized(o)
+	if err != nil {
+		return nil, err
+	}
+	defer o.Close()
+
+	o, err = p.Encrypt(o)
+	if err != nil {
+		return nil, err
+	}
+
 	now := time.Now().Unix()
 	bo := o.GetBaseObject()
 	expires := bo.Expires - now
@@ -170,22 +260,48 @@ func (p *RackspaceProvider) Put(o Object) (Object, error) {
 	if err != nil {
 		return nil, err
 	} else {
+		headers := swift.Headers{
+			"Content-Length":     strconv.FormatInt(size, 10),
+			"X-Delete-After":     strconv.FormatInt(expires, 10),
+			"X-Object-Meta-Till": bo.Metadata,
+		}
+		if len(bo.Checksum) > 0 {
+			headers["X-Object-Meta-Till-Checksum"] = bo.Checksum
+		}
+		if len(bo.Encoding) > 0 {
+			headers["X-Object-Meta-Till-Encoding"] = FormatEncoding(bo)
+		}
+
+		//  Have Swift check the object against its ETag, if it's known up
+		//  front and describes the bytes being stored.
+		checkHash := md5HexPattern.MatchString(bo.ETag) && len(bo.Encoding) == 0 && !IsEncrypted(bo)
+
+		var etag string
+		if checkHash {
+			etag = bo.ETag
+		}
+
 		_, err := p.conn.ObjectPut(
 			p.container.Name,
 			p.GetConfig().RackspacePrefix+path,
 			o,
-			false,
-			"",
+			checkHash,
+			etag,
 			"application/octet-stream",
-			swift.Headers{
-				"Content-Length":     strconv.FormatInt(size, 10),
-				"X-Delete-After":     strconv.FormatInt(expires, 10),
-				"X-Object-Meta-Till": bo.Metadata,
-			})
+			headers)
 		return nil, err
 	}
 }
 
-func (p *RackspaceProvider) Update(o Object) (Object, error) {
+func (p *RackspaceProvider) Update(ctx context.Context, o Object) (Object, error) {
 	return nil, nil
 }
+
+func (p *RackspaceProvider) Delete(ctx context.Context, id string) error {
+	err := p.conn.ObjectDelete(p.container.Name, p.GetConfig().RackspacePrefix+id)
+	if err == swift.ObjectNotFound {
+		return nil
+	} else {
+		return err
+	}
+}
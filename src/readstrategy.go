@@ -0,0 +1,74 @@
+package main
+
+import (
+	"time"
+)
+
+/*
+ *  Read strategies decide the order in which providers are asked for an
+ *  object:
+ *
+ *      race:       every provider at once, and the first to find it wins.
+ *      sequential: one tier at a time, in the order they're configured,
+ *                  moving on once every provider in a tier has missed.
+ *      hedged:     as sequential, but the next tier is also started if a
+ *                  tier hasn't answered within its hedge delay.
+ *
+ *  Each provider is a tier of its own, unless it's given a "tier" name;
+ *  providers with the same name are asked at the same time, in the place of
+ *  the first of them in the config.
+ */
+
+const (
+	ReadRace       = "race"
+	ReadSequential = "sequential"
+	ReadHedged     = "hedged"
+)
+
+// In milliseconds, for tiers that don't set hedge_delay_in_milliseconds.
+const DefaultHedgeDelay = 50
+
+func IsValidReadStrategy(strategy string) bool {
+	return strategy == ReadRace || strategy == ReadSequential || strategy == ReadHedged
+}
+
+type ReadTier struct {
+	Providers  []Provider
+	HedgeDelay time.Duration
+}
+
+// ReadTiers groups providers, which must be in the order they're configured,
+// into the tiers they're read from under strategy. A tier's hedge delay is
+// the longest of its providers'.
+func ReadTiers(providers []Provider, strategy string) []*ReadTier {
+	defaultDelay := time.Duration(state.Config.HedgeDelayInMilliseconds) * time.Millisecond
+
+	if strategy == ReadRace {
+		return []*ReadTier{{Providers: providers, HedgeDelay: defaultDelay}}
+	}
+
+	tiers := make([]*ReadTier, 0, len(providers))
+	named := make(map[string]*ReadTier)
+	for _, p := range providers {
+		tier, exists := named[p.Tier()]
+		if !exists || len(p.Tier()) == 0 {
+			tier = &ReadTier{Providers: make([]Provider, 0, 1), HedgeDelay: -1}
+			tiers = append(tiers, tier)
+			if len(p.Tier()) > 0 {
+				named[p.Tier()] = tier
+			}
+		}
+
+		tier.Providers = append(tier.Providers, p)
+		if p.HedgeDelay() > tier.HedgeDelay {
+			tier.HedgeDelay = p.HedgeDelay()
+		}
+	}
+
+	for _, tier := range tiers {
+		if tier.HedgeDelay < 0 {
+			tier.HedgeDelay = defaultDelay
+		}
+	}
+	return tiers
+}
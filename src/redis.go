@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"github.com/garyburd/redigo/redis"
+	"github.com/nu7hatch/gouuid"
 	"io"
 	"log"
+	"math/rand"
 	"strconv"
 	"strings"
 	"time"
@@ -18,7 +21,13 @@ type RedisProviderConfig struct {
 	Database int    `json:"db"`
 	Password string `json:"password"`
 
-	MaxItems int `json:"maxitems"`
+	MaxItems int   `json:"maxitems"`
+	MaxSize  int64 `json:"maxsize"`
+
+	//  One of "lru", "lfu", "soonest-expiry" or "random".
+	EvictionPolicy string `json:"eviction_policy"`
+
+	DemoteTo []string `json:"demote_to"`
 }
 
 func NewRedisProviderConfig(base BaseProviderConfig, data map[string]interface{}) (*RedisProviderConfig, error) {
@@ -82,20 +91,86 @@ func NewRedisProviderConfig(base BaseProviderConfig, data map[string]interface{}
 		config.MaxItems = 0
 	}
 
+	maxsize, ok := data["maxsize"]
+	if ok {
+		maxsize, ok = maxsize.(float64)
+		if !ok {
+			return nil, errors.New("Redis maxsize must be a number.")
+		} else {
+			config.MaxSize = int64(maxsize.(float64))
+		}
+	} else {
+		config.MaxSize = 0
+	}
+
+	policy, ok := data["eviction_policy"]
+	if ok {
+		config.EvictionPolicy, ok = policy.(string)
+		if !ok {
+			return nil, errors.New("Redis eviction_policy must be a string.")
+		}
+		switch config.EvictionPolicy {
+		case "lru", "lfu", "soonest-expiry", "random":
+		default:
+			return nil, errors.New("Redis eviction_policy must be one of \"lru\", \"lfu\", \"soonest-expiry\" or \"random\".")
+		}
+	} else {
+		config.EvictionPolicy = "lru"
+	}
+
+	demoteTo, err := GetStringList(data, "demote_to")
+	if err != nil {
+		return nil, err
+	}
+	config.DemoteTo = demoteTo
+
 	return &config, nil
 }
 
 type RedisProvider struct {
 	BaseProvider
 
-	pool                 redis.Pool
-	countScript          *redis.Script
-	randomValueKeyScript *redis.Script
+	pool          redis.Pool
+	indexScript   *redis.Script
+	unindexScript *redis.Script
+	pruneScript   *redis.Script
+	touchScript   *redis.Script
+	dropScript    *redis.Script
 }
 
+/*
+ *  Every object is tracked in a set of index keys, so that eviction never
+ *  has to scan the keyspace:
+ *
+ *      ::till:index:access     sorted set of id by last access time
+ *      ::till:index:hits       sorted set of id by number of GETs
+ *      ::till:index:expires    sorted set of id by expiry time, or 0 if none
+ *      ::till:index:sizes      hash of id to size in bytes
+ *      ::till:index:count      number of objects
+ *      ::till:index:bytes      total size of all objects
+ *
+ *  All of the scripts below take these six keys, in this order.
+ */
+
+const redisUnindexFunction = `
+local function unindex(id)
+    local size = redis.call('hget', KEYS[4], id)
+    if not size then
+        return 0
+    end
+    redis.call('hdel', KEYS[4], id)
+    redis.call('decr', KEYS[5])
+    redis.call('decrby', KEYS[6], size)
+    redis.call('zrem', KEYS[1], id)
+    redis.call('zrem', KEYS[2], id)
+    redis.call('zrem', KEYS[3], id)
+    return 1
+end
+`
+
 func (c RedisProviderConfig) NewProvider() (Provider, error) {
 	p := &RedisProvider{
-		BaseProvider: BaseProvider{c},
+		BaseProvider: NewBaseProvider(c),
 	}
 
 	p.pool = redis.Pool{
@@ -124,14 +199,55 @@ func (c RedisProviderConfig) NewProvider() (Provider, error) {
 			return err
 		},
 	}
-	p.countScript = redis.NewScript(0, `return #redis.call('keys', '::till:value:*')`)
-	p.randomValueKeyScript = redis.NewScript(0, `
-		local keys = redis.call('keys', '::till:value:*')
-if #keys > 0 then
-    return keys[1]
+
+	//  ARGV: id, size, expiry time, access time
+	p.indexScript = redis.NewScript(6, `
+local previous = redis.call('hget', KEYS[4], ARGV[1])
+if previous then
+    redis.call('incrby', KEYS[6], tonumber(ARGV[2]) - tonumber(previous))
 else
-    return nil
+    redis.call('incr', KEYS[5])
+    redis.call('incrby', KEYS[6], ARGV[2])
+end
+redis.call('hset', KEYS[4], ARGV[1], ARGV[2])
+redis.call('zadd', KEYS[1], ARGV[4], ARGV[1])
+redis.call('zincrby', KEYS[2], 0, ARGV[1])
+redis.call('zadd', KEYS[3], ARGV[3], ARGV[1])
+return 1
+	`)
+
+	//  ARGV: id
+	p.unindexScript = redis.NewScript(6, redisUnindexFunction+`
+return unindex(ARGV[1])
+	`)
+
+	//  ARGV: current time. Objects without a TTL are indexed as expiring at
+	//  0, which is left out of the range.
+	p.pruneScript = redis.NewScript(6, redisUnindexFunction+`
+local ids = redis.call('zrangebyscore', KEYS[3], '(0', ARGV[1])
+for _, id in ipairs(ids) do
+    unindex(id)
+end
+return #ids
+	`)
+
+	//  ARGV: id. Also takes the object's own keys, from DropArgs, which are
+	//  deleted unless the object has been indexed again (by being written
+	//  afresh) in the meantime.
+	p.dropScript = redis.NewScript(11, `
+if redis.call('hexists', KEYS[4], ARGV[1]) == 1 then
+    return 0
 end
+return redis.call('del', KEYS[7], KEYS[8], KEYS[9], KEYS[10], KEYS[11])
+	`)
+
+	//  ARGV: id, access time
+	p.touchScript = redis.NewScript(6, `
+if redis.call('hexists', KEYS[4], ARGV[1]) == 1 then
+    redis.call('zadd', KEYS[1], ARGV[2], ARGV[1])
+    redis.call('zincrby', KEYS[2], 1, ARGV[1])
+end
+return 1
 	`)
 	return p, nil
 }
@@ -148,93 +264,487 @@ func (p *RedisProvider) KeyForMetadata(key string) string {
 	return "::till:metadata:" + key
 }
 
+func (p *RedisProvider) KeyForETag(key string) string {
+	return "::till:etag:" + key
+}
+
+func (p *RedisProvider) KeyForChecksum(key string) string {
+	return "::till:checksum:" + key
+}
+
+func (p *RedisProvider) KeyForEncoding(key string) string {
+	return "::till:encoding:" + key
+}
+
+func (p *RedisProvider) KeyForIndex(name string) string {
+	return "::till:index:" + name
+}
+
+// IndexArgs prepends the index keys to a script's arguments.
+func (p *RedisProvider) IndexArgs(args ...interface{}) []interface{} {
+	keys := []interface{}{
+		p.KeyForIndex("access"),
+		p.KeyForIndex("hits"),
+		p.KeyForIndex("expires"),
+		p.KeyForIndex("sizes"),
+		p.KeyForIndex("count"),
+		p.KeyForIndex("bytes"),
+	}
+	return append(keys, args...)
+}
+
+// DropArgs returns the arguments for dropScript: the index keys, then
+// the object's own keys, then its id.
+func (p *RedisProvider) DropArgs(id string) []interface{} {
+	return append(p.IndexArgs(
+		p.KeyForMetadata(id),
+		p.KeyForObject(id),
+		p.KeyForETag(id),
+		p.KeyForChecksum(id),
+		p.KeyForEncoding(id),
+	), id)
+}
+
+func (p *RedisProvider) KeyForUpload(key string) (string, error) {
+	u, err := uuid.NewV4()
+	if err != nil {
+		return "", err
+	}
+	return "::till:upload:" + key + ":" + u.String(), nil
+}
+
+func (p *RedisProvider) Connect() error {
+	c := p.pool.Get()
+	defer c.Close()
+
+	exists, err := redis.Bool(c.Do("EXISTS", p.KeyForIndex("count")))
+	if err != nil {
+		//  Redis may come up later; the index will be rebuilt on next start.
+		log.Printf("Could not check index of %v: %v", p, err)
+		return nil
+	} else if !exists {
+		err = p.RebuildIndex(c)
+		if err != nil {
+			log.Printf("Could not rebuild index of %v: %v", p, err)
+		}
+	}
+	return nil
+}
+
+// RebuildIndex indexes every object in the database, for databases that
+// were written to before the index existed.
+func (p *RedisProvider) RebuildIndex(c redis.Conn) error {
+	log.Printf("Rebuilding index of %v...", p)
+
+	_, err := c.Do("DEL", p.IndexArgs()...)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+	cursor := 0
+	for {
+		values, err := redis.Values(c.Do("SCAN", cursor, "MATCH", p.KeyForObject("*"), "COUNT", 1000))
+		if err != nil {
+			return err
+		}
+
+		cursor, err = redis.Int(values[0], nil)
+		if err != nil {
+			return err
+		}
+
+		keys, err := redis.Strings(values[1], nil)
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			id := strings.Replace(key, "::till:value:", "", 1)
+
+			_, err = p.IndexObject(c, id, now)
+			if err != nil {
+				return err
+			}
+		}
+
+		if cursor == 0 {
+			break
+		}
+	}
+
+	//  Make sure the count exists, even if the database is empty.
+	_, err = c.Do("SETNX", p.KeyForIndex("count"), 0)
+	return err
+}
+
+// IndexObject adds an object that's already stored to the index, as last
+// accessed at now. Returns false if the object no longer exists.
+func (p *RedisProvider) IndexObject(c redis.Conn, id string, now int64) (bool, error) {
+	ttl, err := redis.Int64(c.Do("TTL", p.KeyForObject(id)))
+	if err != nil {
+		return false, err
+	} else if ttl == -2 {
+		return false, nil
+	}
+
+	size, err := redis.Int64(c.Do("STRLEN", p.KeyForObject(id)))
+	if err != nil {
+		return false, err
+	}
+
+	//  Objects without a TTL never expire, so aren't pruned, but are
+	//  evicted first by soonest-expiry.
+	expires := int64(0)
+	if ttl >= 0 {
+		expires = now + ttl
+	}
+
+	_, err = p.indexScript.Do(c, p.IndexArgs(id, size, expires, now)...)
+	return err == nil, err
+}
+
 func (p *RedisProvider) GetObjectCount(c redis.Conn) (int, error) {
-	return redis.Int(p.countScript.Do(c))
+	count, err := redis.Int(c.Do("GET", p.KeyForIndex("count")))
+	if err == redis.ErrNil {
+		return 0, nil
+	} else {
+		return count, err
+	}
+}
+
+func (p *RedisProvider) GetTotalSize(c redis.Conn) (int64, error) {
+	size, err := redis.Int64(c.Do("GET", p.KeyForIndex("bytes")))
+	if err == redis.ErrNil {
+		return 0, nil
+	} else {
+		return size, err
+	}
+}
+
+func (p *RedisProvider) Usage() ProviderUsage {
+	config := p.GetConfig()
+	usage := ProviderUsage{
+		Items:    -1,
+		Bytes:    -1,
+		MaxItems: int64(config.MaxItems),
+		MaxSize:  config.MaxSize,
+	}
+
+	c := p.pool.Get()
+	defer c.Close()
+
+	_, err := c.Do("PING")
+	if err == nil {
+		var count int
+		count, err = p.GetObjectCount(c)
+		usage.Items = int64(count)
+	}
+	if err == nil {
+		usage.Bytes, err = p.GetTotalSize(c)
+	}
+	if err != nil {
+		usage.Items = -1
+		usage.Bytes = -1
+		usage.Error = err.Error()
+	} else {
+		usage.Healthy = true
+	}
+	return usage
 }
 
-func (p *RedisProvider) Get(id string) (Object, error) {
+func (p *RedisProvider) Get(ctx context.Context, id string) (Object, error) {
 	c := p.pool.Get()
 	exists, err := redis.Bool(c.Do("EXISTS", p.KeyForObject(id)))
 	if err != nil {
 		return nil, err
 	} else if exists {
 		metadata, _ := redis.String(c.Do("GET", p.KeyForMetadata(id)))
-		return &RedisObject{
-			BaseObject: BaseObject{
-				Metadata:   metadata,
-				identifier: id,
-				exists:     true,
-				provider:   p,
-			},
+		etag, _ := redis.String(c.Do("GET", p.KeyForETag(id)))
+		checksum, _ := redis.String(c.Do("GET", p.KeyForChecksum(id)))
+		encoding, _ := redis.String(c.Do("GET", p.KeyForEncoding(id)))
+
+		ttl, _ := redis.Int64(c.Do("TTL", p.KeyForObject(id)))
+
+		_, err = p.touchScript.Do(c, p.IndexArgs(id, time.Now().Unix())...)
+		if err != nil {
+			log.Printf("Could not record access to object %v: %v", id, err)
+		}
+
+		bo := BaseObject{
+			Metadata:   metadata,
+			ETag:       etag,
+			Checksum:   checksum,
+			identifier: id,
+			exists:     true,
+			provider:   p,
+		}
+		ParseEncoding(encoding, &bo)
+		if ttl >= 0 {
+			bo.Expires = time.Now().Unix() + ttl
+		}
+
+		return p.Decrypt(&RedisObject{
+			BaseObject:  bo,
 			c:           c,
 			objectKey:   p.KeyForObject(id),
 			metadataKey: p.KeyForMetadata(id),
-		}, nil
+		})
 	} else {
 		return nil, nil
 	}
 }
 
-func (p *RedisProvider) GetURL(id string) (Object, error) {
-	return nil, nil
+func (p *RedisProvider) Stat(ctx context.Context, id string) (Object, error) {
+	c := p.pool.Get()
+	defer c.Close()
+
+	ttl, err := redis.Int64(c.Do("TTL", p.KeyForObject(id)))
+	if err != nil {
+		return nil, err
+	} else if ttl == -2 {
+		//	The key does not exist.
+		return nil, nil
+	}
+
+	size, err := redis.Int64(c.Do("STRLEN", p.KeyForObject(id)))
+	if err != nil {
+		return nil, err
+	}
+
+	metadata, _ := redis.String(c.Do("GET", p.KeyForMetadata(id)))
+	etag, _ := redis.String(c.Do("GET", p.KeyForETag(id)))
+	checksum, _ := redis.String(c.Do("GET", p.KeyForChecksum(id)))
+	encoding, _ := redis.String(c.Do("GET", p.KeyForEncoding(id)))
+
+	bo := BaseObject{
+		Metadata:   metadata,
+		ETag:       etag,
+		Checksum:   checksum,
+		identifier: id,
+		exists:     true,
+		provider:   p,
+	}
+	ParseEncoding(encoding, &bo)
+	if ttl >= 0 {
+		bo.Expires = time.Now().Unix() + ttl
+	}
+	return p.Decrypt(&StatObject{BaseObject: bo, size: size})
 }
 
-func (p *RedisProvider) RemoveOldest(c redis.Conn) {
-	keyb, err := redis.String(p.randomValueKeyScript.Do(c))
+func (p *RedisProvider) GetURL(ctx context.Context, id string, expires time.Time) (Object, error) {
+	c := p.pool.Get()
+	defer c.Close()
+
+	exists, err := redis.Bool(c.Do("EXISTS", p.KeyForObject(id)))
+	if err != nil {
+		return nil, err
+	} else if !exists {
+		return nil, nil
+	}
+
+	url, err := p.LocalURL(id)
 	if err != nil {
-		log.Printf("Error: %v", err)
+		return nil, err
 	} else {
-		key := string(keyb)
-		id := strings.Replace(key, "::till:value:", "", 1)
+		return NewURLObject(id, url, p), nil
+	}
+}
+
+// EvictionCandidate picks the next object to evict according to the
+// eviction policy, skipping exclude. Returns "" if there is none.
+func (p *RedisProvider) EvictionCandidate(c redis.Conn, exclude string) (string, error) {
+	key := p.KeyForIndex("access")
+	start := 0
+
+	switch p.GetConfig().EvictionPolicy {
+	case "lfu":
+		key = p.KeyForIndex("hits")
+	case "soonest-expiry":
+		key = p.KeyForIndex("expires")
+	case "random":
+		count, err := redis.Int(c.Do("ZCARD", key))
+		if err != nil {
+			return "", err
+		} else if count > 0 {
+			start = rand.Intn(count)
+		}
+	}
 
-		_, err := c.Do("DEL", p.KeyForMetadata(id), p.KeyForObject(id))
+	ids, err := redis.Strings(c.Do("ZRANGE", key, start, start+1))
+	if err != nil {
+		return "", err
+	}
+
+	if start > 0 {
+		//  Wrap around, in case the random pick was the last object.
+		first, err := redis.Strings(c.Do("ZRANGE", key, 0, 0))
 		if err != nil {
-			log.Printf("Could not remove keys for object %v: %v", id, err)
+			return "", err
+		}
+		ids = append(ids, first...)
+	}
+
+	for _, id := range ids {
+		if id != exclude {
+			return id, nil
 		}
 	}
+	return "", nil
 }
 
-func (p *RedisProvider) Put(o Object) (Object, error) {
-	c := p.pool.Get()
-	defer c.Close()
+func (p *RedisProvider) Evict(ctx context.Context, c redis.Conn, exclude string) error {
+	id, err := p.EvictionCandidate(c, exclude)
+	if err != nil {
+		return err
+	} else if id == "" {
+		return errors.New("No objects left to evict.")
+	}
+	p.Counters().RecordEviction()
 
-	maxItems := p.GetConfig().MaxItems
-	if maxItems > 0 {
-		for {
-			count, err := p.GetObjectCount(c)
+	if len(p.GetConfig().DemoteTo) > 0 {
+		p.Demote(ctx, c, id)
+		return nil
+	}
+
+	log.Printf("Evicting object %v from %v.", id, p)
+	_, err = c.Do("DEL", p.KeyForMetadata(id), p.KeyForObject(id), p.KeyForETag(id), p.KeyForChecksum(id), p.KeyForEncoding(id))
+	if err != nil {
+		log.Printf("Could not remove keys for object %v: %v", id, err)
+		return err
+	}
+
+	_, err = p.unindexScript.Do(c, p.IndexArgs(id)...)
+	return err
+}
+
+// Demote takes an object out of the index, so that it no longer counts
+// towards the provider's limits, then copies it to the demote_to providers
+// in the background. The object is served from here until it's been copied,
+// and is indexed again if the copy fails.
+func (p *RedisProvider) Demote(ctx context.Context, c redis.Conn, id string) {
+	ttl, err := redis.Int64(c.Do("TTL", p.KeyForObject(id)))
+	if err != nil {
+		log.Printf("Could not read TTL of object %v: %v", id, err)
+		ttl = -1
+	}
+
+	_, err = p.unindexScript.Do(c, p.IndexArgs(id)...)
+	if err != nil {
+		log.Printf("Could not remove object %v from index: %v", id, err)
+		return
+	}
+
+	metadata, _ := redis.String(c.Do("GET", p.KeyForMetadata(id)))
+	etag, _ := redis.String(c.Do("GET", p.KeyForETag(id)))
+	checksum, _ := redis.String(c.Do("GET", p.KeyForChecksum(id)))
+	encoding, _ := redis.String(c.Do("GET", p.KeyForEncoding(id)))
+
+	bo := BaseObject{
+		Metadata:   metadata,
+		ETag:       etag,
+		Checksum:   checksum,
+		identifier: id,
+		exists:     true,
+		provider:   p,
+	}
+	ParseEncoding(encoding, &bo)
+	if ttl >= 0 {
+		bo.Expires = time.Now().Unix() + ttl
+	}
+
+	go func() {
+		open := func() (Object, error) {
+			return p.Decrypt(&RedisObject{
+				BaseObject:  bo,
+				c:           p.pool.Get(),
+				objectKey:   p.KeyForObject(id),
+				metadataKey: p.KeyForMetadata(id),
+			})
+		}
+		err := Demote(DetachedContext(ctx), bo, p, open, GetTargetProviders(id, p, p.GetConfig().DemoteTo))
+
+		c := p.pool.Get()
+		defer c.Close()
+		if err != nil {
+			_, err = p.IndexObject(c, id, time.Now().Unix())
 			if err != nil {
-				return nil, err
-			} else {
-				if count+1 > maxItems {
-					p.RemoveOldest(c)
-				} else {
-					break
-				}
+				log.Printf("Could not index object %v again after failing to demote it: %v", id, err)
 			}
+			return
 		}
-	}
+
+		_, err = p.dropScript.Do(c, p.DropArgs(id)...)
+		if err != nil {
+			log.Printf("Could not remove keys for demoted object %v: %v", id, err)
+		}
+	}()
+}
+
+func (p *RedisProvider) Put(ctx context.Context, o Object) (Object, error) {
+	c := p.pool.Get()
+	defer c.Close()
 
 	now := time.Now().Unix()
 	bo := o.GetBaseObject()
 	expires := bo.Expires - now
 
+	//  Forget about anything that has expired since the last Put.
+	expired, err := redis.Int64(p.pruneScript.Do(c, p.IndexArgs(now)...))
+	if err != nil {
+		return nil, err
+	}
+	p.Counters().RecordExpirations(expired)
+
 	exists, err := redis.Bool(c.Do("EXISTS", p.KeyForMetadata(bo.identifier)))
 	if err != nil {
 		return nil, err
 	}
 
 	if exists {
-		return p.Update(o)
+		return p.Update(ctx, o)
 	} else {
 		exists, err = redis.Bool(c.Do("EXISTS", p.KeyForObject(bo.identifier)))
 		if err != nil {
 			return nil, err
 		}
 		if exists {
-			return p.Update(o)
+			return p.Update(ctx, o)
+		}
+	}
+
+	o, err = p.Compress(o)
+	if err != nil {
+		return nil, err
+	}
+	defer o.Close()
+
+	o, err = p.Encrypt(o)
+	if err != nil {
+		return nil, err
+	}
+
+	maxItems := p.GetConfig().MaxItems
+	if maxItems > 0 {
+		for {
+			count, err := p.GetObjectCount(c)
+			if err != nil {
+				return nil, err
+			} else {
+				if count+1 > maxItems {
+					err = p.Evict(ctx, c, "")
+					if err != nil {
+						return nil, err
+					}
+				} else {
+					break
+				}
+			}
 		}
 	}
 
+	maxSize := p.GetConfig().MaxSize
+
 	_, err = c.Do(
 		"SETEX",
 		p.KeyForMetadata(bo.identifier),
@@ -244,30 +754,102 @@ func (p *RedisProvider) Put(o Object) (Object, error) {
 	if err != nil {
 		return nil, err
 	} else {
-		length, err := o.GetSize()
+		//	Stream the object into a temporary key, so that readers never
+		//	see a partially-written object, then move it into place.
+		uploadKey, err := p.KeyForUpload(bo.identifier)
 		if err != nil {
 			return nil, err
 		}
 
-		//	TODO: not this
-		data := make([]byte, length)
-
-		_, err = o.Read(data)
-		if err != nil && err != io.EOF {
+		_, err = c.Do("SETEX", uploadKey, expires, "")
+		if err != nil {
 			return nil, err
 		}
 
-		_, err = c.Do(
-			"SETEX",
-			p.KeyForObject(bo.identifier),
-			expires,
-			data,
-		)
+		var written int64
+		data := make([]byte, 64*1024)
+		for {
+			length, rerr := o.Read(data)
+			if length > 0 {
+				written += int64(length)
+				if maxSize > 0 && written > maxSize {
+					err = errors.New("Object is larger than the Redis maxsize.")
+					break
+				}
+
+				_, err = c.Do("APPEND", uploadKey, data[0:length])
+				if err != nil {
+					break
+				}
+			}
+
+			if rerr == io.EOF {
+				break
+			} else if rerr != nil {
+				err = rerr
+				break
+			}
+		}
+
+		if err == nil && p.Encrypts() {
+			//	An encrypted object's envelope seals its ETag and checksum,
+			//	which are only known now that it's been read.
+			_, err = c.Do("SETEX", p.KeyForMetadata(bo.identifier), expires, o.GetBaseObject().Metadata)
+		}
+
+		if err == nil {
+			//	RENAME carries the TTL of the upload key along with it.
+			_, err = c.Do("RENAME", uploadKey, p.KeyForObject(bo.identifier))
+		}
+
+		if err != nil {
+			c.Do("DEL", uploadKey)
+			c.Do("DEL", p.KeyForMetadata(bo.identifier))
+			return nil, err
+		}
 
+		_, err = p.indexScript.Do(c, p.IndexArgs(bo.identifier, written, bo.Expires, now)...)
 		if err != nil {
 			return nil, err
 		}
 
+		if maxSize > 0 {
+			for {
+				total, err := p.GetTotalSize(c)
+				if err != nil {
+					return nil, err
+				} else if total <= maxSize {
+					break
+				}
+
+				err = p.Evict(ctx, c, bo.identifier)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		//	Now that the object's been read, its ETag and checksum are known.
+		bo = o.GetBaseObject()
+		if len(bo.ETag) > 0 {
+			_, err = c.Do("SETEX", p.KeyForETag(bo.identifier), expires, bo.ETag)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if len(bo.Checksum) > 0 {
+			_, err = c.Do("SETEX", p.KeyForChecksum(bo.identifier), expires, bo.Checksum)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if len(bo.Encoding) > 0 {
+			_, err = c.Do("SETEX", p.KeyForEncoding(bo.identifier), expires, FormatEncoding(bo))
+			if err != nil {
+				return nil, err
+			}
+		}
+
 		return &RedisObject{
 			BaseObject:  bo,
 			c:           p.pool.Get(),
@@ -277,7 +859,7 @@ func (p *RedisProvider) Put(o Object) (Object, error) {
 	}
 }
 
-func (p *RedisProvider) Update(o Object) (Object, error) {
+func (p *RedisProvider) Update(ctx context.Context, o Object) (Object, error) {
 	c := p.pool.Get()
 	defer c.Close()
 
@@ -303,9 +885,59 @@ func (p *RedisProvider) Update(o Object) (Object, error) {
 		return nil, err
 	}
 
+	_, err = c.Do(
+		"EXPIRE",
+		p.KeyForETag(bo.identifier),
+		expires,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = c.Do(
+		"EXPIRE",
+		p.KeyForChecksum(bo.identifier),
+		expires,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = c.Do(
+		"EXPIRE",
+		p.KeyForEncoding(bo.identifier),
+		expires,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	indexed, err := redis.Bool(c.Do("HEXISTS", p.KeyForIndex("sizes"), bo.identifier))
+	if err != nil {
+		return nil, err
+	} else if indexed {
+		_, err = c.Do("ZADD", p.KeyForIndex("expires"), bo.Expires, bo.identifier)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return o, nil
 }
 
+func (p *RedisProvider) Delete(ctx context.Context, id string) error {
+	c := p.pool.Get()
+	defer c.Close()
+
+	_, err := c.Do("DEL", p.KeyForMetadata(id), p.KeyForObject(id), p.KeyForETag(id), p.KeyForChecksum(id), p.KeyForEncoding(id))
+	if err != nil {
+		return err
+	}
+
+	_, err = p.unindexScript.Do(c, p.IndexArgs(id)...)
+	return err
+}
+
 type RedisObject struct {
 	BaseObject  `json:"base"`
 	c           redis.Conn
@@ -333,12 +965,38 @@ func (r *RedisObject) Read(b []byte) (int, error) {
 	data, err := redis.Bytes(r.c.Do("GETRANGE", r.objectKey, r.tell, r.tell+length-1))
 	r.tell += len(data)
 	if err != nil {
-		return -1, err
+		return 0, err
+	} else if len(data) == 0 && length > 0 {
+		return 0, io.EOF
 	} else {
 		return copy(b, data), nil
 	}
 }
 
+func (r *RedisObject) Seek(offset int64, whence int) (int64, error) {
+	var position int64
+	switch whence {
+	case 0:
+		position = offset
+	case 1:
+		position = int64(r.tell) + offset
+	case 2:
+		size, err := r.GetSize()
+		if err != nil {
+			return int64(r.tell), err
+		}
+		position = size + offset
+	default:
+		return int64(r.tell), errors.New("Invalid whence.")
+	}
+
+	if position < 0 {
+		return int64(r.tell), errors.New("Cannot seek to a negative position.")
+	}
+	r.tell = int(position)
+	return position, nil
+}
+
 func (r *RedisObject) Close() error {
 	return r.c.Close()
 }
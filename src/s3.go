@@ -1,13 +1,18 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
-	//"time"
 	"fmt"
 	"io"
 	"launchpad.net/goamz/aws"
 	"log"
+	"net/http"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type S3ProviderConfig struct {
@@ -88,7 +93,7 @@ type S3Provider struct {
 }
 
 func (c S3ProviderConfig) NewProvider() (Provider, error) {
-	p := &S3Provider{BaseProvider: BaseProvider{c}}
+	p := &S3Provider{BaseProvider: NewBaseProvider(c)}
 
 	auth := aws.Auth{
 		AccessKey: c.AWSAccessKeyId,
@@ -106,6 +111,14 @@ type S3Object struct {
 
 	size   int64
 	reader io.ReadCloser
+
+	//	Seeking just moves offset; the next Read re-requests the object
+	//	from S3 with a Range header if offset and position differ.
+	ctx      context.Context
+	bucket   *Bucket
+	path     string
+	position int64
+	offset   int64
 }
 
 func (s *S3Object) GetSize() (int64, error) {
@@ -113,7 +126,66 @@ func (s *S3Object) GetSize() (int64, error) {
 }
 
 func (s *S3Object) Read(buf []byte) (int, error) {
-	return s.reader.Read(buf)
+	if s.offset != s.position {
+		if s.offset >= s.size {
+			return 0, io.EOF
+		}
+
+		err := s.reopen()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	length, err := s.reader.Read(buf)
+	s.position += int64(length)
+	s.offset = s.position
+	return length, err
+}
+
+func (s *S3Object) Seek(offset int64, whence int) (int64, error) {
+	var position int64
+	switch whence {
+	case 0:
+		position = offset
+	case 1:
+		position = s.offset + offset
+	case 2:
+		position = s.size + offset
+	default:
+		return s.offset, errors.New("Invalid whence.")
+	}
+
+	if position < 0 {
+		return s.offset, errors.New("Cannot seek to a negative position.")
+	}
+	s.offset = position
+	return position, nil
+}
+
+func (s *S3Object) reopen() error {
+	s.reader.Close()
+
+	req := &S3Request{
+		bucket: s.bucket.Name,
+		path:   s.path,
+		headers: map[string][]string{
+			"Range": {"bytes=" + strconv.FormatInt(s.offset, 10) + "-"},
+		},
+		ctx: s.ctx,
+	}
+	err := s.bucket.prepare(req)
+	if err != nil {
+		return err
+	}
+	hresp, err := s.bucket.run(req)
+	if err != nil {
+		return err
+	}
+
+	s.reader = hresp.Body
+	s.position = s.offset
+	return nil
 }
 
 func (s *S3Object) Close() error {
@@ -124,11 +196,12 @@ func (p *S3Provider) GetConfig() S3ProviderConfig {
 	return p.config.(S3ProviderConfig)
 }
 
-func (p *S3Provider) Get(id string) (Object, error) {
+func (p *S3Provider) Get(ctx context.Context, id string) (Object, error) {
 	path := p.GetConfig().AWSS3Path + id
 	req := &S3Request{
 		bucket: p.bucket.Name,
 		path:   path,
+		ctx:    ctx,
 	}
 	err := p.bucket.prepare(req)
 	if err != nil {
@@ -146,25 +219,123 @@ func (p *S3Provider) Get(id string) (Object, error) {
 			return nil, err
 		}
 	} else {
-		return &S3Object{
-			BaseObject: BaseObject{
-				Metadata:   hresp.Header.Get("x-amz-meta-till"),
-				identifier: id,
-				exists:     true,
-				provider:   p,
-			},
-			reader: hresp.Body,
-			size:   hresp.ContentLength,
-		}, nil
+		modified, _ := http.ParseTime(hresp.Header.Get("Last-Modified"))
+		expires, _ := strconv.ParseInt(hresp.Header.Get("x-amz-meta-till-expires"), 10, 64)
+		bo := BaseObject{
+			Expires:    expires,
+			Metadata:   hresp.Header.Get("x-amz-meta-till"),
+			ETag:       strings.Trim(hresp.Header.Get("ETag"), "\""),
+			Checksum:   hresp.Header.Get("x-amz-meta-till-checksum"),
+			identifier: id,
+			exists:     true,
+			provider:   p,
+			modified:   modified,
+		}
+		ParseEncoding(hresp.Header.Get("x-amz-meta-till-encoding"), &bo)
+		DiscardStoredETag(&bo)
+
+		return p.Decrypt(&S3Object{
+			BaseObject: bo,
+			reader:     hresp.Body,
+			size:       hresp.ContentLength,
+			ctx:        ctx,
+			bucket:     p.bucket,
+			path:       path,
+		})
 	}
 }
 
-func (p *S3Provider) GetURL(id string) (Object, error) {
-	return nil, nil
+func (p *S3Provider) head(ctx context.Context, path string) (*http.Response, error) {
+	req := &S3Request{
+		method: "HEAD",
+		bucket: p.bucket.Name,
+		path:   path,
+		ctx:    ctx,
+	}
+	err := p.bucket.prepare(req)
+	if err != nil {
+		return nil, err
+	}
+	hresp, err := p.bucket.run(req)
+
+	if err != nil {
+		if s3err, ok := err.(*Error); ok && s3err.StatusCode == 404 {
+			return nil, nil
+		} else {
+			return nil, err
+		}
+	} else {
+		hresp.Body.Close()
+		return hresp, nil
+	}
 }
 
-func (p *S3Provider) Put(o Object) (Object, error) {
+func (p *S3Provider) Stat(ctx context.Context, id string) (Object, error) {
+	hresp, err := p.head(ctx, p.GetConfig().AWSS3Path+id)
+	if err != nil || hresp == nil {
+		return nil, err
+	}
+
+	modified, _ := http.ParseTime(hresp.Header.Get("Last-Modified"))
+	expires, _ := strconv.ParseInt(hresp.Header.Get("x-amz-meta-till-expires"), 10, 64)
+	bo := BaseObject{
+		Expires:    expires,
+		Metadata:   hresp.Header.Get("x-amz-meta-till"),
+		ETag:       strings.Trim(hresp.Header.Get("ETag"), "\""),
+		Checksum:   hresp.Header.Get("x-amz-meta-till-checksum"),
+		identifier: id,
+		exists:     true,
+		provider:   p,
+		modified:   modified,
+	}
+	ParseEncoding(hresp.Header.Get("x-amz-meta-till-encoding"), &bo)
+	DiscardStoredETag(&bo)
+
+	return p.Decrypt(&StatObject{
+		BaseObject: bo,
+		size:       hresp.ContentLength,
+	})
+}
+
+func (p *S3Provider) GetURL(ctx context.Context, id string, expires time.Time) (Object, error) {
+	path := p.GetConfig().AWSS3Path + id
+	hresp, err := p.head(ctx, path)
+	if err != nil || hresp == nil {
+		return nil, err
+	} else if p.Encrypts() || len(hresp.Header.Get("x-amz-meta-till-encoding")) > 0 {
+		//	S3 would serve the object as it's stored, so send clients
+		//	through tilld instead.
+		url, err := p.LocalURL(id)
+		if err != nil {
+			return nil, err
+		}
+		return NewURLObject(id, url, p), nil
+	} else {
+		return NewURLObject(id, p.bucket.SignedURL(path, expires), p), nil
+	}
+}
+
+func (p *S3Provider) Put(ctx context.Context, o Object) (Object, error) {
 	path := p.GetConfig().AWSS3Path + o.GetBaseObject().identifier
+
+	//  The checksum is stored as metadata, and S3 checks the object against
+	//  its MD5 digest, so both must be known before it's sent.
+	err := ReceiveUpload(o)
+	if err != nil {
+		return nil, err
+	}
+
+	o, err = p.CompressSized(o)
+	if err != nil {
+		return nil, err
+	}
+	defer o.Close()
+
+	o, err = p.Encrypt(o)
+	if err != nil {
+		return nil, err
+	}
+
 	size, err := o.GetSize()
 
 	if err != nil {
@@ -176,9 +347,22 @@ func (p *S3Provider) Put(o Object) (Object, error) {
 			"x-amz-acl":           {string(Private)},
 			"x-amz-storage-class": {p.GetConfig().AWSS3StorageClass},
 		}
-		md := o.GetBaseObject().Metadata
-		if len(md) > 0 {
-			headers["x-amz-meta-till"] = []string{md}
+		bo := o.GetBaseObject()
+		if len(bo.Metadata) > 0 {
+			headers["x-amz-meta-till"] = []string{bo.Metadata}
+		}
+		if len(bo.Checksum) > 0 {
+			headers["x-amz-meta-till-checksum"] = []string{bo.Checksum}
+		}
+		//  S3 doesn't expire the object itself, but the expiry is kept so
+		//  that copies made from it (by promote_to, say) can honour it.
+		if bo.Expires > 0 {
+			headers["x-amz-meta-till-expires"] = []string{strconv.FormatInt(bo.Expires, 10)}
+		}
+		if len(bo.Encoding) > 0 {
+			headers["x-amz-meta-till-encoding"] = []string{FormatEncoding(bo)}
+		} else if digest, err := hex.DecodeString(bo.ETag); err == nil && md5HexPattern.MatchString(bo.ETag) && !IsEncrypted(bo) {
+			headers["Content-MD5"] = []string{base64.StdEncoding.EncodeToString(digest)}
 		}
 
 		req := &S3Request{
@@ -187,19 +371,33 @@ func (p *S3Provider) Put(o Object) (Object, error) {
 			path:    path,
 			headers: headers,
 			payload: o,
+			ctx:     ctx,
 		}
 		err := p.bucket.S3.Query(req, nil)
 
 		if err != nil {
 			log.Printf("Could not put file: %v", err)
 			return nil, err
-		} else {
-			return nil, nil
 		}
+		return nil, nil
 	}
 }
 
-func (p *S3Provider) Update(o Object) (Object, error) {
+func (p *S3Provider) Update(ctx context.Context, o Object) (Object, error) {
 	//  TODO: Update the mod time on the S3 object.
 	return nil, nil
 }
+
+func (p *S3Provider) Delete(ctx context.Context, id string) error {
+	req := &S3Request{
+		method: "DELETE",
+		bucket: p.bucket.Name,
+		path:   p.GetConfig().AWSS3Path + id,
+		ctx:    ctx,
+	}
+	err := p.bucket.S3.Query(req, nil)
+	if err != nil {
+		log.Printf("Could not delete file: %v", err)
+	}
+	return err
+}
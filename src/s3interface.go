@@ -12,6 +12,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/xml"
 	"fmt"
 	"io"
@@ -379,6 +380,16 @@ type S3Request struct {
 	baseurl  string
 	payload  io.Reader
 	prepared bool
+
+	// The request is made with ctx, if set.
+	ctx context.Context
+}
+
+func (req *S3Request) context() context.Context {
+	if req.ctx == nil {
+		return context.Background()
+	}
+	return req.ctx
 }
 
 func (req *S3Request) url() (*url.URL, error) {
@@ -489,7 +500,7 @@ func (s3 *S3) run(req *S3Request) (*http.Response, error) {
 		hreq.Body = ioutil.NopCloser(req.payload)
 	}
 
-	hresp, err := http.DefaultClient.Do(&hreq)
+	hresp, err := http.DefaultClient.Do(hreq.WithContext(req.context()))
 	if err != nil {
 		return nil, err
 	}
@@ -497,7 +508,7 @@ func (s3 *S3) run(req *S3Request) (*http.Response, error) {
 		dump, _ := httputil.DumpResponse(hresp, true)
 		log.Printf("} -> %s\n", dump)
 	}
-	if hresp.StatusCode != 200 && hresp.StatusCode != 204 {
+	if hresp.StatusCode != 200 && hresp.StatusCode != 204 && hresp.StatusCode != 206 {
 		return nil, buildError(hresp)
 	}
 	return hresp, err
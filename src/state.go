@@ -20,7 +20,11 @@ type State struct {
 	Identifier string              `json:"identifier"`
 	Server     Server              `json:"server"`
 
+	//  The same providers, in the order they're configured.
+	Ordered []Provider `json:"-"`
+
 	metadataMutex sync.RWMutex `json:"-"`
+	started       time.Time    `json:"-"`
 }
 
 func NewState() State {
@@ -28,6 +32,7 @@ func NewState() State {
 	return InitStateConfig(State{
 		Servers:    make(map[string]Server),
 		Identifier: u.String(),
+		started:    time.Now(),
 	})
 }
 
@@ -48,9 +53,20 @@ func InitStateConfig(state State) State {
 
 	if err != nil {
 		log.Printf("Could not read config from JSON: %v", err)
+	} else {
+		level, _ := ParseLogLevel(state.Config.LogLevel)
+		SetLogLevel(level)
+		ConfigureTracing(state.Config.Tracing)
+	}
+
+	//	The old providers (from before a reload) are disconnected before
+	//	the new ones connect, as they may share files and loops with them.
+	for _, p := range state.Ordered {
+		p.Disconnect()
 	}
 
 	providers := make(map[string]Provider)
+	ordered := make([]Provider, 0, len(state.Config.Providers))
 	for _, pc := range state.Config.Providers {
 		p, err := pc.NewProvider()
 		if err == nil && p != nil {
@@ -63,6 +79,7 @@ func InitStateConfig(state State) State {
 					log.Printf("Could not connect %v provider \"%v\": %v", pc.Type(), pc.Name(), err)
 				} else {
 					providers[pc.Name()] = p
+					ordered = append(ordered, p)
 				}
 			}
 		} else {
@@ -71,6 +88,7 @@ func InitStateConfig(state State) State {
 	}
 
 	state.Providers = providers
+	state.Ordered = ordered
 	state.Server = NewServer(state.Identifier, state.Config.PublicAddress, 60)
 	return state
 }
@@ -87,6 +105,7 @@ func (s *State) AddServer(server Server) error {
 
 	s.metadataMutex.Lock()
 	if _, exists = s.Servers[server.Identifier]; !exists {
+		server.last_contact = time.Now()
 		s.Servers[server.Identifier] = server
 	}
 	count := len(s.Servers)
@@ -101,6 +120,17 @@ func (s *State) AddServer(server Server) error {
 	}
 }
 
+// TouchServer records that a known server has just been heard from.
+func (s *State) TouchServer(id string) {
+	s.metadataMutex.Lock()
+	defer s.metadataMutex.Unlock()
+
+	if server, ok := s.Servers[id]; ok {
+		server.last_contact = time.Now()
+		s.Servers[id] = server
+	}
+}
+
 func (s *State) RemoveServerByID(id string) {
 	s.metadataMutex.Lock()
 	defer s.metadataMutex.Unlock()
@@ -129,7 +159,8 @@ type Server struct {
 	Address    string
 	Lifespan   int64
 
-	added_at time.Time
+	added_at     time.Time
+	last_contact time.Time
 }
 
 func NewServer(id string, addr string, lifespan int64) Server {
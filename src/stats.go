@@ -0,0 +1,324 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+ *  The document served by /api/v1/stats. It's built field by field from each
+ *  provider's counters and usage, and from the server table, rather than by
+ *  marshalling State, so that nothing from the configuration (and no secret
+ *  in it) can ever end up in the output.
+ */
+
+// Latency percentiles are taken over this many of the most recent requests.
+const LatencySamples = 1024
+
+type LatencyStats struct {
+	P50 float64 `json:"p50_ms"`
+	P90 float64 `json:"p90_ms"`
+	P99 float64 `json:"p99_ms"`
+}
+
+type ProviderStats struct {
+	Type    string `json:"type"`
+	Healthy bool   `json:"healthy"`
+	Error   string `json:"error,omitempty"`
+
+	//  -1 if the provider doesn't know; limits are 0 if there are none.
+	Items    int64 `json:"items"`
+	Bytes    int64 `json:"bytes"`
+	MaxItems int64 `json:"max_items"`
+	MaxSize  int64 `json:"max_size"`
+
+	Hits    int64        `json:"hits"`
+	Misses  int64        `json:"misses"`
+	Errors  int64        `json:"errors"`
+	Latency LatencyStats `json:"latency"`
+
+	Circuit CircuitStats `json:"circuit"`
+
+	Details interface{} `json:"details,omitempty"`
+}
+
+type ServerStats struct {
+	Identifier  string `json:"identifier"`
+	Address     string `json:"address"`
+	Expires     int64  `json:"expires"`
+	LastContact int64  `json:"last_contact"`
+}
+
+type Stats struct {
+	Identifier string                   `json:"identifier"`
+	Address    string                   `json:"address"`
+	Started    int64                    `json:"started"`
+	Providers  map[string]ProviderStats `json:"providers"`
+	Servers    []ServerStats            `json:"servers"`
+}
+
+// ProviderUsage is what a provider reports about its own contents and
+// connection. Items and Bytes are -1 if unknown.
+type ProviderUsage struct {
+	Healthy  bool
+	Error    string
+	Items    int64
+	Bytes    int64
+	MaxItems int64
+	MaxSize  int64
+	Details  interface{}
+}
+
+/*
+ *  ProviderCounters tallies the outcome, latency and size of every request
+ *  made to a provider, by operation, along with the objects it evicts and
+ *  expires. Both /api/v1/stats and /metrics are built from these.
+ */
+
+const (
+	OpGet    = "get"
+	OpStat   = "stat"
+	OpGetURL = "geturl"
+	OpPut    = "put"
+	OpUpdate = "update"
+	OpDelete = "delete"
+)
+
+// Upper bounds, in seconds, of the request latency histogram's buckets.
+var LatencyBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type OperationCounters struct {
+	//  Lookups are hits or misses; anything else succeeds.
+	Hits      int64
+	Misses    int64
+	Successes int64
+	Errors    int64
+	Timeouts  int64
+
+	//  Object bytes sent to clients (get) or stored (put).
+	Bytes int64
+
+	//  Count of requests in each of LatencyBuckets, plus one for the rest.
+	Buckets []int64
+	Sum     float64
+	Count   int64
+}
+
+type ProviderCounters struct {
+	mutex sync.Mutex
+
+	operations  map[string]*OperationCounters
+	evictions   int64
+	expirations int64
+
+	lastError     string
+	lastErrorTime time.Time
+	lastSuccess   time.Time
+
+	samples []time.Duration
+	next    int
+}
+
+func NewProviderCounters() *ProviderCounters {
+	return &ProviderCounters{
+		operations: make(map[string]*OperationCounters),
+		samples:    make([]time.Duration, 0, LatencySamples),
+	}
+}
+
+func (c *ProviderCounters) operation(name string) *OperationCounters {
+	op, ok := c.operations[name]
+	if !ok {
+		op = &OperationCounters{Buckets: make([]int64, len(LatencyBuckets)+1)}
+		c.operations[name] = op
+	}
+	return op
+}
+
+// RecordLookup counts a Get, Stat or GetURL that began at started.
+func (c *ProviderCounters) RecordLookup(operation string, started time.Time, found bool, err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	op := c.operation(operation)
+	if err != nil {
+		op.Errors++
+	} else if found {
+		op.Hits++
+	} else {
+		op.Misses++
+	}
+	c.record(op, started, err)
+}
+
+// RecordWrite counts a Put, Update or Delete that began at started.
+func (c *ProviderCounters) RecordWrite(operation string, started time.Time, err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	op := c.operation(operation)
+	if err != nil {
+		op.Errors++
+	} else {
+		op.Successes++
+	}
+	c.record(op, started, err)
+}
+
+// RecordTimeout counts a request that tilld stopped waiting for. The request
+// is still counted by its outcome if it finishes later.
+func (c *ProviderCounters) RecordTimeout(operation string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.operation(operation).Timeouts++
+}
+
+func (c *ProviderCounters) RecordBytes(operation string, bytes int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.operation(operation).Bytes += bytes
+}
+
+func (c *ProviderCounters) RecordEviction() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.evictions++
+}
+
+func (c *ProviderCounters) RecordExpirations(count int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.expirations += count
+}
+
+func (c *ProviderCounters) record(op *OperationCounters, started time.Time, err error) {
+	now := time.Now()
+	if err != nil {
+		c.lastError = err.Error()
+		c.lastErrorTime = now
+	} else {
+		c.lastSuccess = now
+	}
+
+	elapsed := now.Sub(started)
+	if len(c.samples) < LatencySamples {
+		c.samples = append(c.samples, elapsed)
+	} else {
+		c.samples[c.next] = elapsed
+		c.next = (c.next + 1) % LatencySamples
+	}
+
+	seconds := elapsed.Seconds()
+	bucket := sort.SearchFloat64s(LatencyBuckets, seconds)
+	op.Buckets[bucket]++
+	op.Sum += seconds
+	op.Count++
+}
+
+// Snapshot returns a copy of the counters for each operation, and the number
+// of objects evicted and expired.
+func (c *ProviderCounters) Snapshot() (map[string]OperationCounters, int64, int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	operations := make(map[string]OperationCounters, len(c.operations))
+	for name, op := range c.operations {
+		copied := *op
+		copied.Buckets = make([]int64, len(op.Buckets))
+		copy(copied.Buckets, op.Buckets)
+		operations[name] = copied
+	}
+	return operations, c.evictions, c.expirations
+}
+
+// LastError returns the error from the most recent request, if that request
+// failed.
+func (c *ProviderCounters) LastError() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.lastErrorTime.After(c.lastSuccess) {
+		return c.lastError
+	}
+	return ""
+}
+
+// Fill copies the counters, totalled over every operation, into stats.
+func (c *ProviderCounters) Fill(stats *ProviderStats) {
+	c.mutex.Lock()
+	for _, op := range c.operations {
+		stats.Hits += op.Hits
+		stats.Misses += op.Misses
+		stats.Errors += op.Errors
+	}
+	samples := make([]time.Duration, len(c.samples))
+	copy(samples, c.samples)
+	c.mutex.Unlock()
+
+	if len(samples) == 0 {
+		return
+	}
+	sort.Sort(durations(samples))
+	percentile := func(p int) float64 {
+		return float64(samples[(len(samples)-1)*p/100]) / float64(time.Millisecond)
+	}
+	stats.Latency = LatencyStats{
+		P50: percentile(50),
+		P90: percentile(90),
+		P99: percentile(99),
+	}
+}
+
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+func GetStats() Stats {
+	stats := Stats{
+		Identifier: state.Identifier,
+		Address:    state.Server.Address,
+		Started:    state.started.Unix(),
+		Providers:  make(map[string]ProviderStats),
+		Servers:    make([]ServerStats, 0),
+	}
+
+	for name, p := range state.Providers {
+		usage := p.Usage()
+		ps := ProviderStats{
+			Type:     p.Type(),
+			Healthy:  usage.Healthy,
+			Error:    usage.Error,
+			Items:    usage.Items,
+			Bytes:    usage.Bytes,
+			MaxItems: usage.MaxItems,
+			MaxSize:  usage.MaxSize,
+			Details:  usage.Details,
+			Circuit:  p.Breaker().Stats(),
+		}
+		p.Counters().Fill(&ps)
+		stats.Providers[name] = ps
+	}
+
+	state.metadataMutex.RLock()
+	for _, server := range state.Servers {
+		ss := ServerStats{
+			Identifier: server.Identifier,
+			Address:    server.Address,
+			Expires:    server.added_at.Unix() + server.Lifespan,
+		}
+		if !server.last_contact.IsZero() {
+			ss.LastContact = server.last_contact.Unix()
+		}
+		stats.Servers = append(stats.Servers, ss)
+	}
+	state.metadataMutex.RUnlock()
+
+	return stats
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"io"
-	"log"
+	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -67,7 +70,7 @@ type TillProvider struct {
 
 func (c *TillProviderConfig) NewProvider() (Provider, error) {
 	return &TillProvider{
-		BaseProvider: BaseProvider{c},
+		BaseProvider: NewBaseProvider(c),
 	}, nil
 }
 
@@ -79,18 +82,13 @@ func (p *TillProvider) OnServerUp() {
 	go func() {
 		for _, server := range p.GetConfig().Servers {
 			go func(addr string) {
-				NotifyServer(state.Server, NewServer("", addr, 60))
+				NotifyServer(context.Background(), state.Server, NewServer("", addr, 60))
 			}(server)
 		}
 	}()
 }
 
-func (p *TillProvider) Get(id string) (Object, error) {
-	//	Query the other known Till servers and ask for requests by name.
-	//	If any return errors or are not connectable, remove them from the list.
-	//	Return objects from the first server to respond with an object.
-	results := make(chan Object, 0)
-
+func (p *TillProvider) GetServers() []Server {
 	servers := make([]Server, 0)
 	for _, server := range state.Servers {
 		servers = append(servers, server)
@@ -101,27 +99,80 @@ func (p *TillProvider) Get(id string) (Object, error) {
 			servers = append(servers, NewServer("", server_addr, 60))
 		}
 	}
+	return servers
+}
 
-	if len(servers) > 0 {
-		for _, server := range servers {
-			go p.queryServer(id, server, results)
-		}
+// Requests one Till server makes of another carry this header, and are only
+// answered from the receiving server's other providers: passing them on to
+// its till providers would send them back, or around the cluster again.
+const ForwardedHeader = "X-Till-Forwarded"
+
+// How long, in milliseconds, to wait for other Till servers to answer when
+// the provider has no timeout of its own for the operation.
+const TillProviderTimeout = 2000
 
-		//	TODO: Make me configurable
-		timeout := 2000
-		endtime := time.Now().Add(time.Duration(timeout) * time.Millisecond)
+func (p *TillProvider) wait(operation string) time.Duration {
+	if timeout := p.Timeout(operation); timeout > 0 {
+		return timeout
+	}
+	return TillProviderTimeout * time.Millisecond
+}
+
+type tillResult struct {
+	index  int
+	object Object
+}
 
-		for {
-			select {
-			case r := <-results:
-				if r != nil {
-					close(results)
-					return r, nil
+func (p *TillProvider) Get(ctx context.Context, id string) (Object, error) {
+	//	Query the other known Till servers and ask for requests by name.
+	//	Return objects from the first server to respond with an object,
+	//	and cancel the requests to the rest.
+	servers := p.GetServers()
+	if len(servers) == 0 {
+		return nil, nil
+	}
+
+	waiting, stop := context.WithTimeout(ctx, p.wait(OpGet))
+	defer stop()
+
+	//	Each server is queried with a context of its own, so that the
+	//	others can be cancelled without cancelling the one whose object is
+	//	about to be read. That one is cancelled when the object is closed.
+	results := make(chan tillResult, len(servers))
+	cancels := make([]context.CancelFunc, len(servers))
+	for i, server := range servers {
+		var serverCtx context.Context
+		serverCtx, cancels[i] = context.WithCancel(ctx)
+		go p.queryServer(serverCtx, cancels[i], i, id, server, results)
+	}
+
+	winner := -1
+	received := 0
+	defer func() {
+		for i, cancel := range cancels {
+			if i != winner {
+				cancel()
+			}
+		}
+		go func(remaining int) {
+			for ; remaining > 0; remaining-- {
+				if r := <-results; r.object != nil {
+					r.object.Close()
 				}
-			case <-time.After(endtime.Sub(time.Now())):
-				close(results)
-				return nil, nil
 			}
+		}(len(servers) - received)
+	}()
+
+	for received < len(servers) {
+		select {
+		case r := <-results:
+			received++
+			if r.object != nil {
+				winner = r.index
+				return r.object, nil
+			}
+		case <-waiting.Done():
+			return nil, ctx.Err()
 		}
 	}
 	return nil, nil
@@ -132,6 +183,14 @@ type TillObject struct {
 
 	size   int64
 	reader io.ReadCloser
+
+	//	Seeking just moves offset; the next Read re-requests the object
+	//	from the other Till server with a Range header.
+	ctx      context.Context
+	cancel   context.CancelFunc
+	server   Server
+	position int64
+	offset   int64
 }
 
 func (s *TillObject) GetSize() (int64, error) {
@@ -139,63 +198,364 @@ func (s *TillObject) GetSize() (int64, error) {
 }
 
 func (s *TillObject) Read(buf []byte) (int, error) {
-	return s.reader.Read(buf)
+	if s.offset != s.position {
+		if s.size >= 0 && s.offset >= s.size {
+			return 0, io.EOF
+		}
+
+		err := s.reopen()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	length, err := s.reader.Read(buf)
+	s.position += int64(length)
+	s.offset = s.position
+	return length, err
+}
+
+func (s *TillObject) Seek(offset int64, whence int) (int64, error) {
+	var position int64
+	switch whence {
+	case 0:
+		position = offset
+	case 1:
+		position = s.offset + offset
+	case 2:
+		if s.size < 0 {
+			return s.offset, errors.New("Cannot seek from the end of an object of unknown size.")
+		}
+		position = s.size + offset
+	default:
+		return s.offset, errors.New("Invalid whence.")
+	}
+
+	if position < 0 {
+		return s.offset, errors.New("Cannot seek to a negative position.")
+	}
+	s.offset = position
+	return position, nil
+}
+
+func (s *TillObject) reopen() error {
+	s.reader.Close()
+
+	p := s.BaseObject.provider.(*TillProvider)
+	req, err := p.newObjectRequest(s.ctx, "GET", s.identifier, s.server)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Range", "bytes="+strconv.FormatInt(s.offset, 10)+"-")
+
+	client := &http.Client{}
+	span := StartClientSpan(s.ctx, req)
+	resp, err := client.Do(req)
+	span.EndResponse(resp, err)
+	if err != nil {
+		return err
+	} else if resp.StatusCode != 206 {
+		resp.Body.Close()
+		return fmt.Errorf("Till server %v responded to range request with status %d.", s.server.Address, resp.StatusCode)
+	}
+
+	s.reader = resp.Body
+	s.position = s.offset
+	return nil
 }
 
 func (s *TillObject) Close() error {
-	return s.reader.Close()
+	err := s.reader.Close()
+	s.cancel()
+	return err
 }
 
-func (p *TillProvider) queryServer(id string, server Server, results chan Object) {
-	//	Let's supress any panics in this function caused by
-	//	putting objects into a closed channel.
-	defer func() {
-		recover()
-	}()
+func (p *TillProvider) newObjectRequest(ctx context.Context, method string, id string, server Server) (*http.Request, error) {
+	req, err := http.NewRequest(method, "http://"+server.Address+"/api/v1/object/"+id, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
 
+	if len(p.GetConfig().RequestTypes) > 0 {
+		req.Header.Add("X-Till-Providers", strings.Join(p.GetConfig().RequestTypes, ","))
+	}
+	req.Header.Set(ForwardedHeader, "1")
+
+	//  Otherwise the transport asks for gzip and decompresses the body
+	//  itself, leaving the encoded form's ETag on the decoded object.
+	req.Header.Set("Accept-Encoding", "identity")
+	PropagateRequestID(ctx, req)
+	SignClusterRequest(req)
+	return req, nil
+}
+
+func (p *TillProvider) queryServer(ctx context.Context, cancel context.CancelFunc, index int, id string, server Server, results chan tillResult) {
 	client := &http.Client{}
-	req, err := http.NewRequest("GET", "http://"+server.Address+"/api/v1/object/"+id, nil)
+	req, err := p.newObjectRequest(ctx, "GET", id, server)
 	if err != nil {
-		log.Printf("Error making new outgoing Till request: %v", err)
-	} else {
-		if len(p.GetConfig().RequestTypes) > 0 {
-			req.Header.Add("X-Till-Providers", strings.Join(p.GetConfig().RequestTypes, ","))
+		LogFor(ctx).Warnf("Error making new outgoing Till request: %v", err)
+		results <- tillResult{index: index}
+		return
+	}
+
+	span := StartClientSpan(ctx, req)
+	resp, err := client.Do(req)
+	span.EndResponse(resp, err)
+	if err != nil {
+		if ctx.Err() == nil {
+			LogFor(ctx).Warnf("Error making new outgoing Till request: %v", err)
 		}
+		results <- tillResult{index: index}
+		return
+	}
+	state.TouchServer(server.Identifier)
 
-		resp, err := client.Do(req)
-		if err != nil {
-			log.Printf("Error making new outgoing Till request: %v", err)
-		} else {
-			if resp.StatusCode == 200 {
-				results <- &TillObject{
-					BaseObject: BaseObject{
-						Metadata:   resp.Header.Get("X-Till-Metadata"),
-						identifier: id,
-						exists:     true,
-						provider:   p,
-					},
-					reader: resp.Body,
-					size:   resp.ContentLength,
-				}
-			} else {
-				results <- nil
-				resp.Body.Close()
+	if resp.StatusCode != 200 {
+		resp.Body.Close()
+		results <- tillResult{index: index}
+		return
+	}
+
+	expires, _ := strconv.ParseInt(resp.Header.Get("X-Till-Expires"), 10, 64)
+	modified, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	results <- tillResult{index, &TillObject{
+		BaseObject: BaseObject{
+			Expires:    expires,
+			Metadata:   resp.Header.Get("X-Till-Metadata"),
+			ETag:       strings.Trim(resp.Header.Get("ETag"), "\""),
+			Checksum:   resp.Header.Get("X-Till-Checksum"),
+			identifier: id,
+			exists:     true,
+			provider:   p,
+			modified:   modified,
+		},
+		reader: resp.Body,
+		size:   resp.ContentLength,
+		ctx:    ctx,
+		cancel: cancel,
+		server: server,
+	}}
+}
+
+func (p *TillProvider) Stat(ctx context.Context, id string) (Object, error) {
+	//	Ask the other known Till servers about the object,
+	//	and return the first one that has it.
+	servers := p.GetServers()
+	if len(servers) == 0 {
+		return nil, nil
+	}
+
+	//	The requests still running are cancelled once one has answered.
+	ctx, cancel := context.WithTimeout(ctx, p.wait(OpStat))
+	defer cancel()
+
+	results := make(chan Object, len(servers))
+	for _, server := range servers {
+		go p.statServer(ctx, id, server, results)
+	}
+
+	for received := 0; received < len(servers); {
+		select {
+		case r := <-results:
+			received++
+			if r != nil {
+				return r, nil
 			}
+		case <-ctx.Done():
+			return nil, nil
 		}
 	}
+	return nil, nil
+}
 
-	results <- nil
+func (p *TillProvider) statServer(ctx context.Context, id string, server Server, results chan Object) {
+	client := &http.Client{}
+	req, err := p.newObjectRequest(ctx, "HEAD", id, server)
+	if err != nil {
+		LogFor(ctx).Warnf("Error making new outgoing Till request: %v", err)
+		results <- nil
+		return
+	}
+
+	span := StartClientSpan(ctx, req)
+	resp, err := client.Do(req)
+	span.EndResponse(resp, err)
+	if err != nil {
+		if ctx.Err() == nil {
+			LogFor(ctx).Warnf("Error making new outgoing Till request: %v", err)
+		}
+		results <- nil
+		return
+	}
+	resp.Body.Close()
+	state.TouchServer(server.Identifier)
+
+	if resp.StatusCode == 200 {
+		expires, _ := strconv.ParseInt(resp.Header.Get("X-Till-Expires"), 10, 64)
+		modified, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+		results <- &StatObject{
+			BaseObject: BaseObject{
+				Expires:    expires,
+				Metadata:   resp.Header.Get("X-Till-Metadata"),
+				ETag:       strings.Trim(resp.Header.Get("ETag"), "\""),
+				Checksum:   resp.Header.Get("X-Till-Checksum"),
+				identifier: id,
+				exists:     true,
+				provider:   p,
+				modified:   modified,
+			},
+			size: resp.ContentLength,
+		}
+	} else {
+		results <- nil
+	}
 }
 
-func (p *TillProvider) GetURL(id string) (Object, error) {
-	//	TODO: This should return the same URL being queried.
+func (p *TillProvider) GetURL(ctx context.Context, id string, expires time.Time) (Object, error) {
+	//	Ask the other known Till servers for a URL, and return the first one.
+	servers := p.GetServers()
+	if len(servers) == 0 {
+		return nil, nil
+	}
+
+	//	The requests still running are cancelled once one has answered.
+	ctx, cancel := context.WithTimeout(ctx, p.wait(OpGetURL))
+	defer cancel()
+
+	results := make(chan Object, len(servers))
+	for _, server := range servers {
+		go p.queryServerURL(ctx, id, expires, server, results)
+	}
+
+	for received := 0; received < len(servers); {
+		select {
+		case r := <-results:
+			received++
+			if r != nil {
+				return r, nil
+			}
+		case <-ctx.Done():
+			return nil, nil
+		}
+	}
 	return nil, nil
 }
 
-func (p *TillProvider) Put(o Object) (Object, error) {
+func (p *TillProvider) queryServerURL(ctx context.Context, id string, expires time.Time, server Server, results chan Object) {
+	client := &http.Client{}
+	req, err := http.NewRequest("GET", "http://"+server.Address+"/api/v1/object/"+id+"/url", nil)
+	if err != nil {
+		LogFor(ctx).Warnf("Error making new outgoing Till request: %v", err)
+		results <- nil
+		return
+	}
+	req = req.WithContext(ctx)
+
+	if len(p.GetConfig().RequestTypes) > 0 {
+		req.Header.Add("X-Till-Providers", strings.Join(p.GetConfig().RequestTypes, ","))
+	}
+	req.Header.Set(ForwardedHeader, "1")
+	lifespan := expires.Unix() - time.Now().Unix()
+	req.Header.Add("X-Till-URL-Lifespan", strconv.FormatInt(lifespan, 10))
+	PropagateRequestID(ctx, req)
+	SignClusterRequest(req)
+
+	span := StartClientSpan(ctx, req)
+	resp, err := client.Do(req)
+	span.EndResponse(resp, err)
+	if err != nil {
+		if ctx.Err() == nil {
+			LogFor(ctx).Warnf("Error making new outgoing Till request: %v", err)
+		}
+		results <- nil
+		return
+	}
+	defer resp.Body.Close()
+	state.TouchServer(server.Identifier)
+
+	if resp.StatusCode == 200 {
+		url, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			LogFor(ctx).Warnf("Could not read URL from Till server %v: %v", server.Address, err)
+			results <- nil
+		} else {
+			results <- NewURLObject(id, string(url), p)
+		}
+	} else {
+		results <- nil
+	}
+}
+
+func (p *TillProvider) Put(ctx context.Context, o Object) (Object, error) {
 	return nil, nil
 }
 
-func (p *TillProvider) Update(o Object) (Object, error) {
+func (p *TillProvider) Update(ctx context.Context, o Object) (Object, error) {
 	return nil, nil
 }
+
+func (p *TillProvider) Delete(ctx context.Context, id string) error {
+	//	Ask every known Till server to delete the object.
+	//	Unlike Get, all servers must succeed for the delete to succeed.
+	servers := p.GetServers()
+	results := make(chan error, len(servers))
+
+	ctx, cancel := context.WithTimeout(ctx, p.wait(OpDelete))
+	defer cancel()
+
+	for _, server := range servers {
+		go p.deleteFromServer(ctx, id, server, results)
+	}
+
+	for received := 0; received < len(servers); received++ {
+		select {
+		case err := <-results:
+			if err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return errors.New("Timed out deleting object from Till servers.")
+		}
+	}
+	return nil
+}
+
+func (p *TillProvider) deleteFromServer(ctx context.Context, id string, server Server, results chan error) {
+	client := &http.Client{}
+	req, err := http.NewRequest("DELETE", "http://"+server.Address+"/api/v1/object/"+id, nil)
+	if err != nil {
+		LogFor(ctx).Warnf("Error making new outgoing Till request: %v", err)
+		results <- err
+		return
+	}
+	req = req.WithContext(ctx)
+
+	if len(p.GetConfig().RequestTypes) > 0 {
+		req.Header.Add("X-Till-Providers", strings.Join(p.GetConfig().RequestTypes, ","))
+	}
+	req.Header.Set(ForwardedHeader, "1")
+	req.Header.Add("X-Till-Synchronized", "1")
+	PropagateRequestID(ctx, req)
+	SignClusterRequest(req)
+
+	span := StartClientSpan(ctx, req)
+	resp, err := client.Do(req)
+	span.EndResponse(resp, err)
+	if err != nil {
+		if ctx.Err() == nil {
+			LogFor(ctx).Warnf("Error making new outgoing Till request: %v", err)
+		}
+		results <- err
+		return
+	}
+	resp.Body.Close()
+	state.TouchServer(server.Identifier)
+
+	switch resp.StatusCode {
+	case 200, 202, 404:
+		results <- nil
+	default:
+		results <- fmt.Errorf("Till server %v responded with status %d.", server.Address, resp.StatusCode)
+	}
+}
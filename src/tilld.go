@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -21,8 +22,10 @@ import (
 var state State
 
 func main() {
-	log.SetPrefix("tilld " + strconv.Itoa(os.Getpid()) + "\t")
-	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
+	//	Everything logged through the log package is passed on to Log.
+	log.SetPrefix("")
+	log.SetFlags(log.Lshortfile)
+	log.SetOutput(StdLogWriter{})
 
 	logfile := "/var/log/tilld.log"
 	if nlogfile := os.Getenv("LOGFILE"); nlogfile != "" {
@@ -30,29 +33,29 @@ func main() {
 	}
 
 	if logfile == "stdout" {
-		log.SetOutput(os.Stderr)
+		SetLogOutput(os.Stderr)
 	} else {
 		logFile, err := os.OpenFile(logfile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0664)
 		if err != nil {
-			log.SetOutput(os.Stderr)
-			log.Printf("Could not open regular log file: %v", err)
+			SetLogOutput(os.Stderr)
+			Log.Errorf("Could not open regular log file: %v", err)
 		} else {
-			log.SetOutput(logFile)
+			SetLogOutput(logFile)
 		}
 	}
 
-	log.Printf("Initializing tilld...")
+	Log.Infof("Initializing tilld...")
 
 	state = NewState()
-	log.Printf("Instance identifier: %v", state.Identifier)
+	Log.Infof("Instance identifier: %v", state.Identifier)
 
 	usr1chan := make(chan os.Signal, 1)
 	signal.Notify(usr1chan, syscall.SIGUSR1)
 	go func() {
 		for _ = range usr1chan {
-			log.Printf("Reloading configuration from file.")
+			Log.Infof("Reloading configuration from file.")
 			newstate := InitStateConfig(state)
-			log.Printf("Replacing loaded configuration with configuration from disk.")
+			Log.Infof("Replacing loaded configuration with configuration from disk.")
 			state = newstate
 		}
 	}()
@@ -61,17 +64,21 @@ func main() {
 	signal.Notify(termchan, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		for _ = range termchan {
-			log.Printf("Shutting down in response to SIGTERM.")
+			Log.Infof("Shutting down in response to SIGTERM.")
+			ShutdownTracing()
 			os.Exit(0)
 		}
 	}()
 
 	handler := &RegexpHandler{}
-	handler.HandleFunc(regexp.MustCompile("^/api/v1/stats$"), StatsEndpoint)
-	handler.HandleFunc(regexp.MustCompile("^/api/v1/object/"), ObjectGetPutEndpoint)
-	handler.HandleFunc(regexp.MustCompile("^/api/v1/server/[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}"), TillRegistrationEndpoint)
+	handler.HandleFunc(regexp.MustCompile("^/api/v1/stats$"), Authorized(RequireScope(ScopeAdmin), StatsEndpoint))
+	handler.HandleFunc(regexp.MustCompile("^/metrics$"), Authorized(RequireScope(ScopeAdmin), MetricsEndpoint))
+	handler.HandleFunc(regexp.MustCompile("^/api/v1/object/[^/]+/url$"), Authorized(RequireScope(ScopeRead), ObjectURLEndpoint))
+	handler.HandleFunc(regexp.MustCompile("^/api/v1/object/"), Authorized(ObjectScope, ObjectGetPutEndpoint))
+	handler.HandleFunc(regexp.MustCompile("^/api/v1/server/[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}"), Authorized(RequireScope(ScopeCluster), TillRegistrationEndpoint))
+	logged := LogRequests(TraceRequests(handler))
 
-	log.Printf("Starting tilld (pid %d) on port %d. Send SIGUSR1 to reload config.", os.Getpid(), state.Config.Port)
+	Log.Infof("Starting tilld (pid %d) on port %d. Send SIGUSR1 to reload config.", os.Getpid(), state.Config.Port)
 
 	fire_udp_port := os.Getenv("TEST_UDP_PORT")
 	if fire_udp_port != "" {
@@ -91,21 +98,27 @@ func main() {
 
 	if state.Config.Bind != "" {
 		go func() {
-			err := http.ListenAndServe(state.Config.Bind+":"+strconv.Itoa(state.Config.Port), handler)
+			err := http.ListenAndServe(state.Config.Bind+":"+strconv.Itoa(state.Config.Port), logged)
 			if err != nil {
-				log.Printf("ListenAndServe on %v failed: %v", state.Config.Bind, err)
+				Log.Errorf("ListenAndServe on %v failed: %v", state.Config.Bind, err)
 			}
 		}()
 	}
 
-	err := http.ListenAndServe("127.0.0.1:"+strconv.Itoa(state.Config.Port), handler)
+	err := http.ListenAndServe("127.0.0.1:"+strconv.Itoa(state.Config.Port), logged)
 	if err != nil {
-		log.Printf("ListenAndServe on %v failed: %v", state.Config.Bind, err)
+		Log.Errorf("ListenAndServe on %v failed: %v", state.Config.Bind, err)
 	}
 }
 
 func StatsEndpoint(writer http.ResponseWriter, r *http.Request) {
-	b, _ := json.Marshal(state)
+	b, err := json.Marshal(GetStats())
+	if err != nil {
+		LogFor(r.Context()).Errorf("Could not marshal stats: %v", err)
+		http.Error(writer, "\"Could not marshal stats.\"", 500)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
 	writer.Write(b)
 }
 
@@ -129,7 +142,9 @@ func TillRegistrationEndpoint(writer http.ResponseWriter, r *http.Request) {
 		}
 
 		if _, exists := state.Servers[id]; !exists {
-			go NotifyServer(state.Server, NewServer(id, address, int64(lifespan)))
+			go NotifyServer(DetachedContext(r.Context()), state.Server, NewServer(id, address, int64(lifespan)))
+		} else {
+			state.TouchServer(id)
 		}
 
 		data, err := json.Marshal(state.Server)
@@ -141,7 +156,7 @@ func TillRegistrationEndpoint(writer http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func SendKnownServersTo(target Server) {
+func SendKnownServersTo(ctx context.Context, target Server) {
 	servers := make(map[string]Server)
 	state.metadataMutex.RLock()
 	for id, known := range state.Servers {
@@ -153,23 +168,23 @@ func SendKnownServersTo(target Server) {
 
 	for id, known := range servers {
 		if id != target.Identifier && id != state.Identifier {
-			NotifyServer(known, target)
+			NotifyServer(ctx, known, target)
 		}
 	}
 }
 
-func NotifyServer(source Server, target Server) {
+func NotifyServer(ctx context.Context, source Server, target Server) {
 	client := &http.Client{}
 
 	if target.Identifier != "" {
 		if target.Identifier != state.Identifier {
-			log.Printf("Notifying %v of %v", target.Identifier, source.Identifier)
+			Log.Infof("Notifying %v of %v", target.Identifier, source.Identifier)
 		} else {
 			return
 		}
 	} else {
 		if target.Address != state.Server.Address {
-			log.Printf("Notifying %v of %v", target.Address, source.Identifier)
+			Log.Infof("Notifying %v of %v", target.Address, source.Identifier)
 		} else {
 			return
 		}
@@ -177,14 +192,18 @@ func NotifyServer(source Server, target Server) {
 
 	req, err := http.NewRequest("POST", "http://"+target.Address+"/api/v1/server/"+source.Identifier, bytes.NewReader([]byte{}))
 	if err != nil {
-		log.Printf("Error making new outgoing Till request: %v", err)
+		Log.Warnf("Error making new outgoing Till request: %v", err)
 	} else {
 		req.Header.Add("X-Till-Address", source.Address)
+		PropagateRequestID(ctx, req)
+		SignClusterRequest(req)
 		//	TODO: Implement me.
 		//req.Header.Add("X-Till-Lifespan", source.Lifespan)
+		span := StartClientSpan(ctx, req)
 		resp, err := client.Do(req)
+		span.EndResponse(resp, err)
 		if err != nil {
-			log.Printf("Error making new outgoing Till request: %v", err)
+			Log.Warnf("Error making new outgoing Till request: %v", err)
 		} else {
 			if resp.StatusCode == 200 {
 				decoder := json.NewDecoder(resp.Body)
@@ -192,15 +211,17 @@ func NotifyServer(source Server, target Server) {
 				err = decoder.Decode(&received)
 
 				if err != nil {
-					log.Printf("Could not decode data from other server: %v", err)
+					Log.Warnf("Could not decode data from other server: %v", err)
 				} else {
 					err = state.AddServer(received)
 					if err == nil {
-						SendKnownServersTo(received)
+						SendKnownServersTo(ctx, received)
+					} else {
+						state.TouchServer(received.Identifier)
 					}
 				}
 			} else {
-				log.Printf("Response code from Till server not 200 - assuming down.")
+				Log.Warnf("Response code from Till server not 200 - assuming down.")
 				//	TODO: Remove server from list.
 			}
 			resp.Body.Close()
@@ -212,17 +233,28 @@ func ObjectGetPutEndpoint(writer http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
 		ObjectGetEndpoint(writer, r)
+	case "HEAD":
+		ObjectHeadEndpoint(writer, r)
 	case "POST":
 		ObjectPostEndpoint(writer, r)
 	case "PUT":
 		ObjectUpdateEndpoint(writer, r)
+	case "DELETE":
+		ObjectDeleteEndpoint(writer, r)
 	default:
 		http.Error(writer, "Method not allowed.", 405)
 	}
 }
 
 func GetID(writer http.ResponseWriter, r *http.Request) *string {
-	id_re := regexp.MustCompile("^/api/v1/object/([a-zA-Z0-9_\\-.]+)$")
+	return GetIDMatching(writer, r, regexp.MustCompile("^/api/v1/object/([a-zA-Z0-9_\\-.]+)$"))
+}
+
+func GetURLID(writer http.ResponseWriter, r *http.Request) *string {
+	return GetIDMatching(writer, r, regexp.MustCompile("^/api/v1/object/([a-zA-Z0-9_\\-.]+)/url$"))
+}
+
+func GetIDMatching(writer http.ResponseWriter, r *http.Request, id_re *regexp.Regexp) *string {
 	ids := id_re.FindStringSubmatch(r.URL.Path)
 	if len(ids) == 2 {
 		return &ids[1]
@@ -265,81 +297,451 @@ func (r *RequestResult) ForJSON() (string, map[string]string) {
 	return (*(r.Provider)).Name(), data
 }
 
-func QueryProvider(id string, p Provider, result chan RequestResult) {
-	obj, err := p.Get(id)
+func QueryProvider(ctx context.Context, id string, p Provider, result chan RequestResult) {
+	ctx, span := StartProviderSpan(ctx, p, OpGet, id)
+	started := time.Now()
+	obj, err, timedOut := CallProvider(ctx, p, OpGet, func(ctx context.Context) (Object, error) {
+		return p.Get(ctx, id)
+	})
+	if timedOut {
+		p.Counters().RecordTimeout(OpGet)
+	} else if !Cancelled(ctx, err) {
+		p.Counters().RecordLookup(OpGet, started, obj != nil, err)
+	}
+	RecordCircuit(ctx, p, err, timedOut)
+	span.SetAttribute("till.found", obj != nil)
+	span.End(err)
 
-	defer func(obj Object) {
-		if r := recover(); r != nil {
-			if obj != nil {
-				obj.Close()
-			}
+	result <- RequestResult{&p, &obj, err, timedOut, obj == nil && err == nil}
+}
+
+// Cancelled returns whether err came from a request that was cancelled -
+// because another provider answered first, or the request timed out or was
+// abandoned - rather than from a failing provider.
+func Cancelled(ctx context.Context, err error) bool {
+	return err != nil && ctx.Err() != nil
+}
+
+type providerAnswer struct {
+	object Object
+	err    error
+}
+
+// CallProvider makes a request to p, limited by the provider's own timeout
+// for the operation if it has one, and reports whether that timeout passed.
+// Not every provider watches its context, so CallProvider stops waiting once
+// the timeout has passed, and closes anything the request returns later.
+func CallProvider(ctx context.Context, p Provider, operation string, call func(context.Context) (Object, error)) (Object, error, bool) {
+	timeout := p.Timeout(operation)
+	if timeout <= 0 {
+		obj, err := call(ctx)
+		return obj, err, false
+	}
+
+	//	The context isn't cancelled once the provider answers, since the
+	//	object it returns may still be reading from it; it ends with ctx.
+	limited, cancel := context.WithCancel(ctx)
+	expired := time.AfterFunc(timeout, cancel)
+
+	answered := make(chan providerAnswer, 1)
+	go func() {
+		obj, err := call(limited)
+		answered <- providerAnswer{obj, err}
+	}()
+
+	select {
+	case a := <-answered:
+		expired.Stop()
+		return a.object, a.err, false
+
+	case <-limited.Done():
+		if ctx.Err() != nil {
+			a := <-answered
+			return a.object, a.err, false
 		}
-	}(obj)
 
-	result <- RequestResult{&p, &obj, err, false, obj == nil && err == nil}
+		go func() {
+			if a := <-answered; a.object != nil {
+				a.object.Close()
+			}
+		}()
+		return nil, errors.New(p.Name() + " did not answer within " + timeout.String() + "."), true
+	}
 }
 
-func ObjectGetEndpoint(writer http.ResponseWriter, r *http.Request) {
-	id := GetID(writer, r)
-	if id != nil {
-		var o RequestResult
-		was_timeout := false
+// RecordCircuit tells p's circuit breaker how a request went. Requests that
+// were cancelled say nothing about the provider, so aren't counted.
+func RecordCircuit(ctx context.Context, p Provider, err error, timedOut bool) {
+	if timedOut {
+		p.Breaker().Failure()
+	} else if Cancelled(ctx, err) {
+		return
+	} else if err != nil {
+		p.Breaker().Failure()
+	} else {
+		p.Breaker().Success()
+	}
+}
 
-		timeout := state.Config.GetTimeoutInMilliseconds
-		dispatched := 0
-		received := 0
-		successful := 0
-		result := make(chan RequestResult)
-		defer close(result)
-		results := make(map[string]map[string]string)
+func QueryProviderURL(ctx context.Context, id string, expires time.Time, p Provider, result chan RequestResult) {
+	ctx, span := StartProviderSpan(ctx, p, OpGetURL, id)
+	started := time.Now()
+	obj, err, timedOut := CallProvider(ctx, p, OpGetURL, func(ctx context.Context) (Object, error) {
+		return p.GetURL(ctx, id, expires)
+	})
+	if timedOut {
+		p.Counters().RecordTimeout(OpGetURL)
+	} else if !Cancelled(ctx, err) {
+		p.Counters().RecordLookup(OpGetURL, started, obj != nil && obj.URL() != nil, err)
+	}
+	RecordCircuit(ctx, p, err, timedOut)
+	span.SetAttribute("till.found", obj != nil && obj.URL() != nil)
+	span.End(err)
+
+	notFound := err == nil && (obj == nil || obj.URL() == nil)
+	result <- RequestResult{&p, &obj, err, timedOut, notFound}
+}
+
+func GetURLLifespan(r *http.Request) (float64, error) {
+	lifespan_s := r.Header.Get("X-Till-URL-Lifespan")
+	if len(lifespan_s) == 0 || lifespan_s == "default" {
+		return float64(state.Config.DefaultURLLifespan), nil
+	} else {
+		lifespan, err := strconv.ParseFloat(lifespan_s, 64)
+		if err != nil || lifespan <= 0 {
+			return -1, errors.New("X-Till-URL-Lifespan header is not a positive integer.")
+		} else {
+			return lifespan, nil
+		}
+	}
+}
+
+func ObjectURLEndpoint(writer http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(writer, "Method not allowed.", 405)
+		return
+	}
+
+	id := GetURLID(writer, r)
+	if id != nil {
+		lifespan, err := GetURLLifespan(r)
+		if err != nil {
+			http.Error(writer, "\""+err.Error()+"\"", 400)
+			return
+		}
+		expires := time.Now().Add(time.Duration(lifespan) * time.Second)
 
 		providers, _ := GetProviders(r, *id)
-		for _, p := range providers {
-			go QueryProvider(*id, p, result)
-			dispatched++
+		found := FindObject(r.Context(), *id, OpGetURL, providers, func(ctx context.Context, p Provider, result chan RequestResult) {
+			QueryProviderURL(ctx, *id, expires, p, result)
+		})
+
+		if found.Object != nil {
+			SetAnsweringProvider(r, *(found.Object.Provider))
+			writer.Header().Set("Content-Type", "text/plain")
+			writer.Write([]byte(*(*(found.Object.Object)).URL()))
+		} else {
+			found.WriteError(writer, providers)
 		}
-		endtime := time.Now().Add(time.Duration(timeout) * time.Millisecond)
+	}
+}
 
-	Join:
-		for {
-			select {
-			case o = <-result:
-				k, v := o.ForJSON()
-				results[k] = v
+type FindResult struct {
+	//	The first successful result, or nil if none was found.
+	Object *RequestResult
 
-				received++
-				if o.Error == nil && !o.NotFound {
-					successful++
-					break Join
+	Results    map[string]map[string]string
+	Failed     bool
+	WasTimeout bool
+	Timeout    int
+}
+
+// FindObject queries providers according to the read strategy, and returns
+// as soon as one of them finds the object, all of them have answered, or the
+// timeout passes. The queries still running are then cancelled, and anything
+// they return is closed.
+func FindObject(ctx context.Context, id string, operation string, providers []Provider, query func(context.Context, Provider, chan RequestResult)) *FindResult {
+	found := &FindResult{
+		Results: make(map[string]map[string]string),
+		Timeout: state.Config.GetTimeoutInMilliseconds,
+	}
+
+	if len(providers) == 0 {
+		return found
+	}
+
+	tiers := ReadTiers(providers, state.Config.ReadStrategy)
+	next := 0
+
+	//	Each provider gets a context of its own, so that the others can be
+	//	cancelled without cancelling the one whose object is about to be
+	//	read. Its context ends with the request.
+	dispatched := 0
+	received := 0
+	result := make(chan RequestResult, len(providers))
+	cancels := make(map[string]context.CancelFunc, len(providers))
+
+	//	Providers whose circuits are open are skipped, along with any tier
+	//	left with nothing to query.
+	var hedge <-chan time.Time
+	startTier := func() {
+		hedge = nil
+		for next < len(tiers) {
+			tier := tiers[next]
+			next++
+
+			started := 0
+			for _, p := range tier.Providers {
+				if !p.Breaker().Allow() {
+					found.Results[p.Name()] = p.Breaker().ForJSON()
+					found.Failed = true
+					continue
+				}
+
+				queryCtx, cancel := context.WithCancel(ctx)
+				cancels[p.Name()] = cancel
+				go query(queryCtx, p, result)
+				dispatched++
+				started++
+			}
+
+			if started > 0 {
+				if state.Config.ReadStrategy == ReadHedged && next < len(tiers) {
+					hedge = time.After(tier.HedgeDelay)
 				}
+				return
+			}
+		}
+	}
+	startTier()
+	if dispatched == 0 {
+		return found
+	}
+
+	waiting, stop := context.WithTimeout(ctx, time.Duration(found.Timeout)*time.Millisecond)
+	defer stop()
 
+	defer func() {
+		for name, cancel := range cancels {
+			if found.Object == nil || (*found.Object.Provider).Name() != name {
+				cancel()
+			}
+		}
+		go DiscardResults(result, dispatched-received)
+	}()
+
+	for {
+		select {
+		case o := <-result:
+			k, v := o.ForJSON()
+			found.Results[k] = v
+
+			received++
+			if o.Error == nil && !o.NotFound {
+				found.Object = &o
+				return found
+			} else if o.Error != nil {
+				found.Failed = true
+			}
+
+			if received == dispatched {
+				startTier()
 				if received == dispatched {
-					break Join
+					return found
+				}
+			}
+
+		case <-hedge:
+			startTier()
+
+		case <-waiting.Done():
+			if ctx.Err() != nil {
+				LogFor(ctx).Infof("Request for object %s was abandoned.", id)
+			} else {
+				LogFor(ctx).Warnf("Timeout exceeded when getting object %s.", id)
+				found.WasTimeout = true
+				for _, tier := range tiers[next:] {
+					for _, p := range tier.Providers {
+						found.Results[p.Name()] = map[string]string{"status": "SKIPPED"}
+					}
 				}
+				RecordTimeouts(operation, providers, found.Results)
+			}
+			return found
+		}
+	}
+}
+
+// DiscardResults waits for the results of queries that are no longer needed,
+// and closes any objects they return.
+func DiscardResults(result chan RequestResult, count int) {
+	for i := 0; i < count; i++ {
+		o := <-result
+		if o.Object != nil && *o.Object != nil {
+			(*o.Object).Close()
+		}
+	}
+}
 
-			case <-time.After(endtime.Sub(time.Now())):
-				log.Printf("Timeout exceeded when getting object %s.", *id)
-				was_timeout = true
-				break Join
+// RecordTimeouts counts a timeout, and a failure towards opening its circuit,
+// against every provider that hasn't answered.
+func RecordTimeouts(operation string, providers []Provider, results map[string]map[string]string) {
+	for _, p := range providers {
+		if _, exists := results[p.Name()]; !exists {
+			p.Counters().RecordTimeout(operation)
+			p.Breaker().Failure()
+		}
+	}
+}
+
+// WriteError responds to a request for which no object was found.
+func (found *FindResult) WriteError(writer http.ResponseWriter, providers []Provider) {
+	if found.WasTimeout {
+		for _, p := range providers {
+			if _, exists := found.Results[p.Name()]; !exists {
+				found.Results[p.Name()] = map[string]string{
+					"status":     "TIMEOUT",
+					"timeout_ms": strconv.FormatInt(int64(found.Timeout), 10),
+				}
 			}
 		}
 
-		if !o.NotFound && o.Error == nil && o.Object != nil {
-			obj := *(o.Object)
+		jsondata, err := json.Marshal(found.Results)
+		if err != nil {
+			Log.Errorf("Could not marshal error result data: %v", err)
+			http.Error(writer, "\"Failed to find object within given time.\"", 504)
+		} else {
+			http.Error(writer, string(jsondata), 504)
+		}
+	} else if found.Failed {
+		jsondata, err := json.Marshal(found.Results)
+		if err != nil {
+			Log.Errorf("Could not marshal error result data: %v", err)
+			http.Error(writer, "\"Upstream provider failed to query object.\"", 503)
+		} else {
+			http.Error(writer, string(jsondata), 503)
+		}
+	} else {
+		http.Error(writer, "\"Failed to find object.\"", 404)
+	}
+}
+
+func ObjectGetEndpoint(writer http.ResponseWriter, r *http.Request) {
+	id := GetID(writer, r)
+	if id != nil {
+		providers, _ := GetProviders(r, *id)
+		found := FindObject(r.Context(), *id, OpGet, providers, func(ctx context.Context, p Provider, result chan RequestResult) {
+			QueryProvider(ctx, *id, p, result)
+		})
+
+		if found.Object != nil && found.Object.Object != nil {
+			SetAnsweringProvider(r, *(found.Object.Provider))
+			obj := *(found.Object.Object)
 			defer obj.Close()
 
+			counted := &CountingResponseWriter{ResponseWriter: writer}
+			writer = counted
+			defer func(source Provider) {
+				source.Counters().RecordBytes(OpGet, counted.written)
+			}(*(found.Object.Provider))
+
+			bo := obj.GetBaseObject()
+			if len(bo.Metadata) > 0 {
+				writer.Header().Set("X-Till-Metadata", bo.Metadata)
+			}
+			if bo.Expires > 0 {
+				writer.Header().Set("X-Till-Expires", strconv.FormatInt(bo.Expires, 10))
+			}
+			if len(bo.Checksum) > 0 {
+				writer.Header().Set("X-Till-Checksum", bo.Checksum)
+			}
+
+			//	Compressed objects are sent as they're stored to clients that
+			//	accept their encoding, and decompressed for everyone else.
+			//	The two forms have different ETags.
+			encoded := false
+			etag := bo.ETag
+			if len(bo.Encoding) > 0 {
+				writer.Header().Set("Vary", "Accept-Encoding")
+				if AcceptsEncoding(r.Header.Get("Accept-Encoding"), bo.Encoding) {
+					writer.Header().Set("Content-Encoding", bo.Encoding)
+					etag = EncodedETag(bo.ETag, bo.Encoding)
+					encoded = true
+				} else {
+					decoded, err := DecodeObject(obj)
+					if err != nil {
+						LogFor(r.Context()).Errorf("Could not decompress object %v from %v: %v", *id, *(found.Object.Provider), err)
+						http.Error(writer, "\"Could not decompress the object.\"", 500)
+						return
+					}
+					defer decoded.Close()
+					obj = decoded
+					bo = obj.GetBaseObject()
+				}
+			}
+			if len(etag) > 0 {
+				writer.Header().Set("ETag", "\""+etag+"\"")
+			}
+
 			size, err := obj.GetSize()
+
+			//	Copy the object into faster providers as it's sent, if configured.
+			if err == nil && size >= 0 {
+				source := *(found.Object.Provider)
+				targets := GetTargetProviders(*id, source, source.PromoteTo())
+				if len(targets) > 0 {
+					if bw := NewBackfillWriter(writer); bw != nil {
+						writer = bw
+						defer bw.Finish(r.Context(), bo, size, targets)
+					}
+				}
+			}
+
+			//	Verify the object against its checksum as it's sent. If it
+			//	doesn't match, the connection is dropped before the last byte.
+			var checked *ChecksumObject
+			if len(bo.Checksum) > 0 && !encoded {
+				if err == nil {
+					checked = NewChecksumObject(obj, bo.Checksum, size)
+				} else {
+					checked = NewChecksumObject(obj, bo.Checksum, -1)
+				}
+				defer func() {
+					if checked.Err() == ErrChecksumMismatch {
+						LogFor(r.Context()).Errorf("Object %v from %v does not match its checksum.", *id, *(found.Object.Provider))
+						panic(http.ErrAbortHandler)
+					}
+				}()
+			}
+
+			//	Seekable objects of known size can serve Range and
+			//	conditional requests; anything else is streamed in full.
+			if seekable, ok := obj.(SeekableObject); ok && err == nil && size >= 0 {
+				if checked != nil {
+					seekable = &SeekableChecksumObject{checked}
+				}
+				writer.Header().Set("Content-Type", "application/octet-stream")
+				http.ServeContent(writer, r, "", bo.modified, seekable)
+				return
+			}
+
+			var reader io.Reader = obj
+			if checked != nil {
+				reader = checked
+			}
+
+			if len(etag) > 0 && MatchesETag(r.Header.Get("If-None-Match"), etag) {
+				writer.WriteHeader(304)
+				return
+			}
+
 			if err == nil && size != -1 {
 				writer.Header().Set("Content-Length", strconv.FormatInt(size, 10))
 			}
-			metadata := obj.GetBaseObject().Metadata
-			if len(metadata) > 0 {
-				writer.Header().Set("X-Till-Metadata", metadata)
-			}
 
 			data := make([]byte, 4096)
 			for {
-				length, err := obj.Read(data)
+				length, err := reader.Read(data)
 				if length == 0 || (err != nil && err != io.EOF) {
 					break
 				} else {
@@ -350,46 +752,108 @@ func ObjectGetEndpoint(writer http.ResponseWriter, r *http.Request) {
 					break
 				}
 			}
-			return
-		} else if was_timeout {
-			providers, _ := GetProviders(r, *id)
-			for _, p := range providers {
-				if _, exists := results[p.Name()]; !exists {
-					results[p.Name()] = map[string]string{
-						"status":     "TIMEOUT",
-						"timeout_ms": strconv.FormatInt(int64(timeout), 10),
-					}
-				}
+		} else {
+			found.WriteError(writer, providers)
+		}
+	}
+}
+
+func QueryProviderStat(ctx context.Context, id string, p Provider, result chan RequestResult) {
+	ctx, span := StartProviderSpan(ctx, p, OpStat, id)
+	started := time.Now()
+	obj, err, timedOut := CallProvider(ctx, p, OpStat, func(ctx context.Context) (Object, error) {
+		return p.Stat(ctx, id)
+	})
+	if timedOut {
+		p.Counters().RecordTimeout(OpStat)
+	} else if !Cancelled(ctx, err) {
+		p.Counters().RecordLookup(OpStat, started, obj != nil, err)
+	}
+	RecordCircuit(ctx, p, err, timedOut)
+	span.SetAttribute("till.found", obj != nil)
+	span.End(err)
+
+	result <- RequestResult{&p, &obj, err, timedOut, obj == nil && err == nil}
+}
+
+func ObjectHeadEndpoint(writer http.ResponseWriter, r *http.Request) {
+	id := GetID(writer, r)
+	if id != nil {
+		providers, _ := GetProviders(r, *id)
+		found := FindObject(r.Context(), *id, OpStat, providers, func(ctx context.Context, p Provider, result chan RequestResult) {
+			QueryProviderStat(ctx, *id, p, result)
+		})
+
+		if found.Object != nil && found.Object.Object != nil {
+			SetAnsweringProvider(r, *(found.Object.Provider))
+			obj := *(found.Object.Object)
+			defer obj.Close()
+
+			bo := obj.GetBaseObject()
+			if len(bo.Metadata) > 0 {
+				writer.Header().Set("X-Till-Metadata", bo.Metadata)
+			}
+			if bo.Expires > 0 {
+				writer.Header().Set("X-Till-Expires", strconv.FormatInt(bo.Expires, 10))
+			}
+			if len(bo.Checksum) > 0 {
+				writer.Header().Set("X-Till-Checksum", bo.Checksum)
 			}
+			if !bo.modified.IsZero() {
+				writer.Header().Set("Last-Modified", bo.modified.UTC().Format(http.TimeFormat))
+			}
+			writer.Header().Set("X-Till-Provider", (*(found.Object.Provider)).Name())
 
-			jsondata, err := json.Marshal(results)
-			if err != nil {
-				log.Printf("Could not marshal error result data: %v", err)
-				http.Error(writer, "\"Failed to find object within given time.\"", 504)
-			} else {
-				http.Error(writer, string(jsondata), 504)
+			//	As with GET, report the size of whatever would be sent.
+			size, err := obj.GetSize()
+			etag := bo.ETag
+			if len(bo.Encoding) > 0 {
+				writer.Header().Set("Vary", "Accept-Encoding")
+				if AcceptsEncoding(r.Header.Get("Accept-Encoding"), bo.Encoding) {
+					writer.Header().Set("Content-Encoding", bo.Encoding)
+					etag = EncodedETag(bo.ETag, bo.Encoding)
+				} else {
+					size = bo.DecodedSize
+				}
 			}
-		} else if successful < dispatched && !o.NotFound {
-			jsondata, err := json.Marshal(results)
-			if err != nil {
-				log.Printf("Could not marshal error result data: %v", err)
-				http.Error(writer, "\"Upstream provider failed to query object.\"", 503)
+			if len(etag) > 0 {
+				writer.Header().Set("ETag", "\""+etag+"\"")
+			}
+			if err == nil && size != -1 {
+				writer.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+			}
+
+			if len(etag) > 0 && MatchesETag(r.Header.Get("If-None-Match"), etag) {
+				writer.WriteHeader(304)
 			} else {
-				http.Error(writer, string(jsondata), 503)
+				writer.WriteHeader(200)
 			}
 		} else {
-			http.Error(writer, "\"Failed to find object.\"", 404)
+			found.WriteError(writer, providers)
+		}
+	}
+}
+
+func MatchesETag(header string, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == "\""+etag+"\"" {
+			return true
 		}
 	}
+	return false
 }
 
-func GetProviders(r *http.Request, id string) (map[string]Provider, error) {
+// GetProviders returns the providers to use for a request, in the order
+// they're configured - or the order given in X-Till-Providers, if given.
+// Requests forwarded by another Till server skip till providers.
+func GetProviders(r *http.Request, id string) ([]Provider, error) {
 	var err error
-	target_providers := make(map[string]Provider)
+	target_providers := make([]Provider, 0, len(state.Ordered))
 
-	for name, provider := range state.Providers {
+	for _, provider := range state.Ordered {
 		if provider.AcceptsKey(id) {
-			target_providers[name] = provider
+			target_providers = append(target_providers, provider)
 		}
 	}
 
@@ -397,20 +861,32 @@ func GetProviders(r *http.Request, id string) (map[string]Provider, error) {
 	if len(specified_providers) > 0 {
 		provider_list := strings.Split(specified_providers, ",")
 
-		target_providers = make(map[string]Provider)
+		target_providers = make([]Provider, 0, len(provider_list))
+		specified := make(map[string]bool)
 		for _, s := range provider_list {
 			provider, ok := state.Providers[s]
 			if ok {
-				if _, exists := target_providers[s]; !exists {
-					target_providers[s] = provider
+				if !specified[s] {
+					specified[s] = true
+					target_providers = append(target_providers, provider)
 				}
 			} else {
-				log.Printf("Specified provider \"%v\" not found.", s)
+				LogFor(r.Context()).Warnf("Specified provider \"%v\" not found.", s)
 				err = errors.New(fmt.Sprintf("Specified provider \"%v\" not found.", s))
 			}
 		}
 	}
 
+	if len(r.Header.Get(ForwardedHeader)) > 0 {
+		local_providers := make([]Provider, 0, len(target_providers))
+		for _, provider := range target_providers {
+			if provider.Type() != "till" {
+				local_providers = append(local_providers, provider)
+			}
+		}
+		target_providers = local_providers
+	}
+
 	return target_providers, err
 }
 
@@ -430,6 +906,14 @@ func GetSynchronized(r *http.Request) (bool, error) {
 	}
 }
 
+func GetMetadata(r *http.Request) (string, error) {
+	metadata := r.Header.Get("X-Till-Metadata")
+	if strings.HasPrefix(metadata, EncryptedMetadataPrefix) {
+		return "", ErrReservedMetadata
+	}
+	return metadata, nil
+}
+
 func GetLifespan(id string, r *http.Request) (float64, error) {
 	lifespan_s := r.Header.Get("X-Till-Lifespan")
 	if len(lifespan_s) > 0 {
@@ -459,7 +943,18 @@ func ObjectPostEndpoint(writer http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		buf := NewFullyBufferedReader(r.Body)
+		metadata, err := GetMetadata(r)
+		if err != nil {
+			jsondata, _ := json.Marshal(err.Error())
+			http.Error(writer, string(jsondata), 400)
+			return
+		}
+
+		maxSize := state.Config.MaxObjectSize
+		if maxSize > 0 && r.ContentLength > maxSize {
+			http.Error(writer, "\""+ErrObjectTooLarge.Error()+"\"", 413)
+			return
+		}
 
 		bo := BaseObject{
 			exists:     false,
@@ -467,7 +962,7 @@ func ObjectPostEndpoint(writer http.ResponseWriter, r *http.Request) {
 			provider:   nil,
 
 			Expires:  now.Add(time.Duration(lifespan) * time.Second).Unix(),
-			Metadata: r.Header.Get("X-Till-Metadata"),
+			Metadata: metadata,
 		}
 
 		synchronous, err := GetSynchronized(r)
@@ -476,56 +971,63 @@ func ObjectPostEndpoint(writer http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		//	TODO: Dispatch to each provider should have a timeout associated with it.
-		var o RequestResult
-
-		was_timeout := false
-
-		timeout := 1000 // msec
+		timeout := state.Config.PostTimeoutInMilliseconds
 		dispatched := 0
-		received := 0
-		successful := 0
-		result := make(chan RequestResult)
-		defer close(result)
-
 		results := make(map[string]map[string]string)
 
 		providers, provider_error := GetProviders(r, *id)
-		for _, p := range providers {
-			go SaveObject(p, bo, buf, r.ContentLength, result)
-			dispatched++
+		result := make(chan RequestResult, len(providers))
+
+		//	Content-addressed objects are read in full and checked against
+		//	their key before any provider sees them.
+		var body io.Reader = r.Body
+		if IsContentAddressed(*id, providers) {
+			spooled, err := SpoolContentAddressed(*id, r.Body, maxSize)
+			if err == ErrKeyNotDigest || err == ErrDigestMismatch || err == ErrContentDigestMismatch {
+				http.Error(writer, "\""+err.Error()+"\"", 400)
+				return
+			} else if err == ErrObjectTooLarge {
+				http.Error(writer, "\""+err.Error()+"\"", 413)
+				return
+			} else if err != nil {
+				LogFor(r.Context()).Errorf("Could not read object %s: %v", *id, err)
+				http.Error(writer, "\"Could not read the object.\"", 500)
+				return
+			}
+			defer os.Remove(spooled.Name())
+			defer spooled.Close()
+			body = spooled
 		}
 
-		endtime := time.Now().Add(time.Duration(timeout) * time.Millisecond)
+		//	The request body is streamed to every provider at once.
+		fanout := NewFanOutWriter(body, maxSize, state.Config.UploadBufferSize)
+		defer fanout.Close()
 
-		if dispatched > 0 {
-		Join:
-			for {
-				select {
-				case o = <-result:
-					k, v := o.ForJSON()
-					results[k] = v
-
-					received++
-					if o.Error == nil {
-						successful++
-
-						if !synchronous || received == dispatched {
-							break Join
-						}
-					} else if received == dispatched {
-						break Join
-					}
-
-				case <-time.After(endtime.Sub(time.Now())):
-					if synchronous {
-						log.Printf("Timeout exceeded when posting object %s.", *id)
-						was_timeout = true
-					}
-					break Join
-				}
+		//	Once one provider has the object, an unsynchronized request
+		//	returns and the rest carry on in the background, so the uploads
+		//	don't end with the request. They're cancelled if the request
+		//	fails, times out or is abandoned instead.
+		uploads, cancel := context.WithCancel(DetachedContext(r.Context()))
+		for _, p := range providers {
+			if !p.Breaker().Allow() {
+				results[p.Name()] = p.Breaker().ForJSON()
+				continue
 			}
+			go SaveObject(uploads, p, bo, fanout.Reader(), r.ContentLength, result)
+			dispatched++
 		}
+		fanout.Start()
+
+		received, successful, was_timeout := JoinWrites(r.Context(), OpPut, *id, timeout, synchronous, providers, result, dispatched, results)
+		if successful == 0 || synchronous {
+			cancel()
+		}
+		go func(remaining int) {
+			for i := 0; i < remaining; i++ {
+				<-result
+			}
+			cancel()
+		}(dispatched - received)
 
 		if dispatched == 0 && provider_error != nil {
 			jsondata, _ := json.Marshal(provider_error.Error())
@@ -537,6 +1039,10 @@ func ObjectPostEndpoint(writer http.ResponseWriter, r *http.Request) {
 			writer.WriteHeader(202)
 		} else if successful > 0 { // && synchronous
 			writer.WriteHeader(201)
+		} else if fanout.Err() == ErrObjectTooLarge {
+			http.Error(writer, "\""+ErrObjectTooLarge.Error()+"\"", 413)
+		} else if fanout.Err() == ErrContentDigestMismatch {
+			http.Error(writer, "\""+ErrContentDigestMismatch.Error()+"\"", 400)
 		} else if was_timeout {
 			providers, _ := GetProviders(r, *id)
 			for _, p := range providers {
@@ -550,17 +1056,19 @@ func ObjectPostEndpoint(writer http.ResponseWriter, r *http.Request) {
 
 			jsondata, err := json.Marshal(results)
 			if err != nil {
-				log.Printf("Could not marshal error result data: %v", err)
+				Log.Errorf("Could not marshal error result data: %v", err)
 				http.Error(writer, "\"Failed to find object within given time.\"", 504)
 			} else {
 				http.Error(writer, string(jsondata), 504)
 			}
-		} else if dispatched == 0 {
+		} else if len(providers) == 0 {
 			http.Error(writer, "\"No providers could handle the provided key. Ensure that whitelists are appropriately configured.\"", 404)
+		} else if dispatched == 0 {
+			WriteCircuitsOpen(writer, results)
 		} else {
 			jsondata, err := json.Marshal(results)
 			if err != nil {
-				log.Printf("Could not marshal error result data: %v", err)
+				Log.Errorf("Could not marshal error result data: %v", err)
 				http.Error(writer, "\"Failed to find object due to upstream errors.\"", 502)
 			} else {
 				http.Error(writer, string(jsondata), 502)
@@ -569,30 +1077,110 @@ func ObjectPostEndpoint(writer http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func SaveObject(p Provider, bo BaseObject, buf *FullyBufferedReader, size int64, result chan RequestResult) {
-	//	Let's supress any panics in this function caused by
-	//	putting objects into a closed channel.
-	defer func() {
-		recover()
-	}()
+// WriteCircuitsOpen responds to a request that couldn't be made to any
+// provider, because all of their circuits were open.
+func WriteCircuitsOpen(writer http.ResponseWriter, results map[string]map[string]string) {
+	jsondata, err := json.Marshal(results)
+	if err != nil {
+		Log.Errorf("Could not marshal error result data: %v", err)
+		http.Error(writer, "\"All providers are unavailable.\"", 503)
+	} else {
+		http.Error(writer, string(jsondata), 503)
+	}
+}
+
+// The verbs that describe each kind of write, for logging.
+var writeVerbs = map[string]string{
+	OpPut:    "post",
+	OpUpdate: "update",
+	OpDelete: "delete",
+}
+
+// JoinWrites collects the results of a write sent to dispatched providers
+// into results. An unsynchronized write only waits for the first provider
+// to succeed; a synchronized one waits for all of them, and reports if the
+// timeout (in milliseconds) passed first. Providers that haven't answered
+// by then have a timeout recorded against them.
+func JoinWrites(ctx context.Context, operation string, id string, timeout int, synchronous bool, providers []Provider, result chan RequestResult, dispatched int, results map[string]map[string]string) (int, int, bool) {
+	received := 0
+	successful := 0
+	if dispatched == 0 {
+		return received, successful, false
+	}
+
+	waiting, stop := context.WithTimeout(ctx, time.Duration(timeout)*time.Millisecond)
+	defer stop()
+
+	for {
+		select {
+		case o := <-result:
+			k, v := o.ForJSON()
+			results[k] = v
+
+			received++
+			if o.Error == nil {
+				successful++
+				if !synchronous {
+					return received, successful, false
+				}
+			}
+			if received == dispatched {
+				return received, successful, false
+			}
+
+		case <-waiting.Done():
+			if ctx.Err() != nil {
+				LogFor(ctx).Infof("Request to %s object %s was abandoned.", writeVerbs[operation], id)
+				return received, successful, false
+			}
+
+			RecordTimeouts(operation, providers, results)
+			if synchronous {
+				LogFor(ctx).Warnf("Timeout exceeded when trying to %s object %s.", writeVerbs[operation], id)
+			}
+			return received, successful, synchronous
+		}
+	}
+}
 
-	obj := UploadObject{
-		BaseObject: bo,
-		reader:     buf.Reader(),
-		size:       size,
+func SaveObject(ctx context.Context, p Provider, bo BaseObject, reader *FanOutReader, size int64, result chan RequestResult) {
+	ctx, span := StartProviderSpan(ctx, p, OpPut, bo.identifier)
+	started := time.Now()
+	o, err, timedOut := CallProvider(ctx, p, OpPut, func(ctx context.Context) (Object, error) {
+		obj := UploadObject{
+			BaseObject: bo,
+			reader:     reader,
+			size:       size,
+		}
+		defer obj.Close()
+		return p.Put(ctx, &obj)
+	})
+	if timedOut {
+		p.Counters().RecordTimeout(OpPut)
+	} else if !Cancelled(ctx, err) {
+		p.Counters().RecordWrite(OpPut, started, err)
 	}
-	defer obj.Close()
-	o, err := p.Put(&obj)
+
+	//	A body that was too large or couldn't be read isn't the provider's
+	//	fault.
+	if upstream := reader.fanout.Err(); upstream == nil || upstream == io.EOF {
+		RecordCircuit(ctx, p, err, timedOut)
+	}
+	if err == nil {
+		p.Counters().RecordBytes(OpPut, reader.offset)
+		span.SetAttribute("till.bytes", reader.offset)
+	}
+	span.End(err)
 	if o != nil {
 		o.Close()
 	}
 	if err != nil {
-		log.Printf("Error saving object %v to %v: %v", bo.identifier, p, err)
+		LogFor(ctx).Errorf("Error saving object %v to %v: %v", bo.identifier, p, err)
 		result <- RequestResult{
 			Provider: &p,
 			Object:   &o,
 			Error:    err,
-			Timeout:  false,
+			Timeout:  timedOut,
 			NotFound: false,
 		}
 	} else {
@@ -606,24 +1194,34 @@ func SaveObject(p Provider, bo BaseObject, buf *FullyBufferedReader, size int64,
 	}
 }
 
-func UpdateObject(p Provider, bo BaseObject, result chan *Object) {
-	//	Let's supress any panics in this function caused by
-	//	putting objects into a closed channel.
-	defer func() {
-		recover()
-	}()
-
-	obj := UploadObject{BaseObject: bo}
-	defer obj.Close()
-	o, err := p.Update(&obj)
+func UpdateObject(ctx context.Context, p Provider, bo BaseObject, result chan RequestResult) {
+	ctx, span := StartProviderSpan(ctx, p, OpUpdate, bo.identifier)
+	started := time.Now()
+	o, err, timedOut := CallProvider(ctx, p, OpUpdate, func(ctx context.Context) (Object, error) {
+		obj := UploadObject{BaseObject: bo}
+		defer obj.Close()
+		return p.Update(ctx, &obj)
+	})
+	if timedOut {
+		p.Counters().RecordTimeout(OpUpdate)
+	} else if !Cancelled(ctx, err) {
+		p.Counters().RecordWrite(OpUpdate, started, err)
+	}
+	RecordCircuit(ctx, p, err, timedOut)
+	span.End(err)
 	if err != nil {
-		log.Printf("Error updating object %v to %v: %v", bo.identifier, p, err)
-		result <- nil
+		LogFor(ctx).Errorf("Error updating object %v to %v: %v", bo.identifier, p, err)
 		if o != nil {
 			o.Close()
+			o = nil
 		}
-	} else {
-		result <- &o
+	}
+	result <- RequestResult{
+		Provider: &p,
+		Object:   &o,
+		Error:    err,
+		Timeout:  timedOut,
+		NotFound: false,
 	}
 }
 
@@ -651,56 +1249,134 @@ func ObjectUpdateEndpoint(writer http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		//	TODO: Dispatch to all providers should happen at once, not sequentially.
-		//	TODO: Dispatch to each provider should have a timeout associated with it.
-		was_timeout := false
-
-		timeout := 1000 // msec
+		timeout := state.Config.UpdateTimeoutInMilliseconds
 		dispatched := 0
-		received := 0
-		successful := 0
-		result := make(chan *Object)
-
+		results := make(map[string]map[string]string)
 		providers, _ := GetProviders(r, *id)
+		result := make(chan RequestResult, len(providers))
+
+		//	Updates that haven't finished when the response is sent carry
+		//	on in the background.
 		for _, p := range providers {
-			go UpdateObject(p, bo, result)
+			if !p.Breaker().Allow() {
+				results[p.Name()] = p.Breaker().ForJSON()
+				continue
+			}
+			go UpdateObject(DetachedContext(r.Context()), p, bo, result)
 			dispatched++
 		}
 
-		endtime := time.Now().Add(time.Duration(timeout) * time.Millisecond)
+		_, successful, was_timeout := JoinWrites(r.Context(), OpUpdate, *id, timeout, synchronous, providers, result, dispatched, results)
 
-	Join:
-		for {
-			select {
-			case o := <-result:
-				received++
-				if o != nil {
-					successful++
+		if successful > 0 && (!synchronous || successful < dispatched) {
+			writer.WriteHeader(202)
+		} else if successful > 0 { // && synchronous
+			writer.WriteHeader(201)
+		} else if was_timeout {
+			writer.WriteHeader(504)
+		} else if dispatched == 0 && len(results) > 0 {
+			WriteCircuitsOpen(writer, results)
+		} else {
+			writer.WriteHeader(502)
+		}
+	}
+}
 
-					if !synchronous || received == dispatched {
-						break Join
-					}
-				} else if received == dispatched {
-					break Join
-				}
+func DeleteObject(ctx context.Context, p Provider, id string, result chan RequestResult) {
+	ctx, span := StartProviderSpan(ctx, p, OpDelete, id)
+	started := time.Now()
+	_, err, timedOut := CallProvider(ctx, p, OpDelete, func(ctx context.Context) (Object, error) {
+		return nil, p.Delete(ctx, id)
+	})
+	if timedOut {
+		p.Counters().RecordTimeout(OpDelete)
+	} else if !Cancelled(ctx, err) {
+		p.Counters().RecordWrite(OpDelete, started, err)
+	}
+	RecordCircuit(ctx, p, err, timedOut)
+	span.End(err)
+	if err != nil {
+		LogFor(ctx).Errorf("Error deleting object %v from %v: %v", id, p, err)
+	}
+	result <- RequestResult{
+		Provider: &p,
+		Object:   nil,
+		Error:    err,
+		Timeout:  timedOut,
+		NotFound: false,
+	}
+}
 
-			case <-time.After(endtime.Sub(time.Now())):
-				if synchronous {
-					log.Printf("Timeout exceeded when posting object %s.", *id)
-					was_timeout = true
-				}
-				break Join
+func ObjectDeleteEndpoint(writer http.ResponseWriter, r *http.Request) {
+	id := GetID(writer, r)
+
+	if id != nil {
+		synchronous, err := GetSynchronized(r)
+		if err != nil {
+			http.Error(writer, "\""+err.Error()+"\"", 400)
+			return
+		}
+
+		timeout := state.Config.DeleteTimeoutInMilliseconds
+		dispatched := 0
+		results := make(map[string]map[string]string)
+
+		providers, provider_error := GetProviders(r, *id)
+		result := make(chan RequestResult, len(providers))
+
+		//	Deletes that haven't finished when the response is sent carry
+		//	on in the background.
+		for _, p := range providers {
+			if !p.Breaker().Allow() {
+				results[p.Name()] = p.Breaker().ForJSON()
+				continue
 			}
+			go DeleteObject(DetachedContext(r.Context()), p, *id, result)
+			dispatched++
+		}
+
+		_, successful, was_timeout := JoinWrites(r.Context(), OpDelete, *id, timeout, synchronous, providers, result, dispatched, results)
+
+		if dispatched == 0 && provider_error != nil {
+			jsondata, _ := json.Marshal(provider_error.Error())
+			http.Error(writer, string(jsondata), 404)
+			return
 		}
 
 		if successful > 0 && (!synchronous || successful < dispatched) {
 			writer.WriteHeader(202)
 		} else if successful > 0 { // && synchronous
-			writer.WriteHeader(201)
+			writer.WriteHeader(200)
 		} else if was_timeout {
-			writer.WriteHeader(504)
+			providers, _ := GetProviders(r, *id)
+			for _, p := range providers {
+				if _, exists := results[p.Name()]; !exists {
+					results[p.Name()] = map[string]string{
+						"status":     "TIMEOUT",
+						"timeout_ms": strconv.FormatInt(int64(timeout), 10),
+					}
+				}
+			}
+
+			jsondata, err := json.Marshal(results)
+			if err != nil {
+				Log.Errorf("Could not marshal error result data: %v", err)
+				http.Error(writer, "\"Failed to delete object within given time.\"", 504)
+			} else {
+				http.Error(writer, string(jsondata), 504)
+			}
+		} else if len(providers) == 0 {
+			http.Error(writer, "\"No providers could handle the provided key. Ensure that whitelists are appropriately configured.\"", 404)
+		} else if dispatched == 0 {
+			WriteCircuitsOpen(writer, results)
 		} else {
-			writer.WriteHeader(502)
+			jsondata, err := json.Marshal(results)
+			if err != nil {
+				Log.Errorf("Could not marshal error result data: %v", err)
+				http.Error(writer, "\"Failed to delete object due to upstream errors.\"", 502)
+			} else {
+				http.Error(writer, string(jsondata), 502)
+			}
 		}
 	}
 }
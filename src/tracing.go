@@ -0,0 +1,634 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	mathrand "math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ *  Tracing. Each HTTP request gets a root span, and each call it makes to a
+ *  provider - and each request a provider makes to another Till server - gets
+ *  a child span, so a slow request can be broken down by where its time went.
+ *
+ *  Trace context is passed between Till servers (and from any client that
+ *  sends one) in the W3C traceparent header:
+ *
+ *      traceparent: 00-<32 hex trace id>-<16 hex parent span id>-<2 hex flags>
+ *
+ *  Finished spans are exported in batches as OTLP/JSON, either POSTed to an
+ *  OTLP collector or appended one batch per line to a local file.
+ */
+
+const (
+	TraceBatchSize     = 256
+	TraceQueueSize     = 4096
+	TraceFlushInterval = 5 * time.Second
+
+	DefaultOTLPEndpoint = "http://127.0.0.1:4318/v1/traces"
+)
+
+type TracingConfig struct {
+	//  "otlp" or "file"; tracing is off if this is empty or "none".
+	Exporter    string            `json:"exporter"`
+	Endpoint    string            `json:"endpoint"`
+	Headers     map[string]string `json:"headers"`
+	Path        string            `json:"path"`
+	ServiceName string            `json:"service_name"`
+
+	//  The fraction of new traces to record. Traces started by another
+	//  server or client keep the sampling decision they arrive with.
+	SampleRatio *float64 `json:"sample_ratio"`
+}
+
+// Validate returns a copy of the config with defaults filled in, or nil if
+// tracing is off or can't be set up as configured.
+func (t TracingConfig) Validate() *TracingConfig {
+	valid := t
+
+	switch t.Exporter {
+	case "", "none":
+		return nil
+	case "otlp":
+		if len(valid.Endpoint) == 0 {
+			valid.Endpoint = DefaultOTLPEndpoint
+		}
+	case "file":
+		if len(valid.Path) == 0 {
+			log.Printf("Tracing disabled: path must be given for the file exporter.")
+			return nil
+		}
+	default:
+		log.Printf("Tracing disabled: exporter must be \"otlp\", \"file\" or \"none\".")
+		return nil
+	}
+
+	if len(valid.ServiceName) == 0 {
+		valid.ServiceName = "tilld"
+	}
+
+	ratio := 1.0
+	if t.SampleRatio != nil {
+		if *t.SampleRatio >= 0 && *t.SampleRatio <= 1 {
+			ratio = *t.SampleRatio
+		} else {
+			log.Printf("sample_ratio must be between 0 and 1; recording every trace.")
+		}
+	}
+	valid.SampleRatio = &ratio
+
+	return &valid
+}
+
+/*
+ *  Spans.
+ */
+
+type SpanKind int
+
+// Span kinds, as numbered by OTLP.
+const (
+	SpanInternal SpanKind = 1
+	SpanServer   SpanKind = 2
+	SpanClient   SpanKind = 3
+)
+
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+func (c SpanContext) Traceparent() string {
+	flags := "00"
+	if c.Sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(c.TraceID[:]) + "-" + hex.EncodeToString(c.SpanID[:]) + "-" + flags
+}
+
+// ParseTraceparent reads a W3C traceparent header.
+func ParseTraceparent(header string) (SpanContext, bool) {
+	var c SpanContext
+
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return c, false
+	}
+	//  Version 00 has exactly four fields; later versions may add more.
+	if parts[0] == "00" && len(parts) != 4 {
+		return c, false
+	}
+
+	traceID, err := hex.DecodeString(parts[1])
+	if err != nil || len(traceID) != 16 || parts[1] != strings.ToLower(parts[1]) {
+		return c, false
+	}
+	spanID, err := hex.DecodeString(parts[2])
+	if err != nil || len(spanID) != 8 || parts[2] != strings.ToLower(parts[2]) {
+		return c, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || len(flags) != 1 {
+		return c, false
+	}
+
+	copy(c.TraceID[:], traceID)
+	copy(c.SpanID[:], spanID)
+	if c.TraceID == [16]byte{} || c.SpanID == [8]byte{} {
+		return c, false
+	}
+	c.Sampled = flags[0]&1 == 1
+	return c, true
+}
+
+type spanAttribute struct {
+	key   string
+	value interface{}
+}
+
+type Span struct {
+	SpanContext
+
+	parent [8]byte
+	name   string
+	kind   SpanKind
+	start  time.Time
+	tracer *tracer
+
+	mutex      sync.Mutex
+	end        time.Time
+	attributes []spanAttribute
+	err        error
+}
+
+type spanContextKey struct{}
+
+func withSpanContext(ctx context.Context, c SpanContext) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, c)
+}
+
+// SpanContextFrom returns the context of the span that ctx belongs to, if any.
+func SpanContextFrom(ctx context.Context) (SpanContext, bool) {
+	c, ok := ctx.Value(spanContextKey{}).(SpanContext)
+	return c, ok
+}
+
+// StartSpan starts a span as a child of the one ctx belongs to, or as the root
+// of a new trace. The span is nil if tracing is off; its methods can still be
+// called.
+func StartSpan(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	t := currentTracer()
+	if t == nil {
+		return ctx, nil
+	}
+
+	span := &Span{
+		name:   name,
+		kind:   kind,
+		start:  time.Now(),
+		tracer: t,
+	}
+	if parent, ok := SpanContextFrom(ctx); ok {
+		span.TraceID = parent.TraceID
+		span.parent = parent.SpanID
+		span.Sampled = parent.Sampled
+	} else {
+		rand.Read(span.TraceID[:])
+		span.Sampled = mathrand.Float64() < *t.config.SampleRatio
+	}
+	rand.Read(span.SpanID[:])
+
+	return withSpanContext(ctx, span.SpanContext), span
+}
+
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.attributes = append(s.attributes, spanAttribute{key, value})
+}
+
+// End finishes the span, marking it as failed if err is non-nil. Only the
+// first call has any effect.
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	if !s.end.IsZero() {
+		s.mutex.Unlock()
+		return
+	}
+	s.end = time.Now()
+	s.err = err
+	s.mutex.Unlock()
+
+	if s.Sampled {
+		s.tracer.enqueue(s)
+	}
+}
+
+// StartProviderSpan starts a span for a call to a provider.
+func StartProviderSpan(ctx context.Context, p Provider, operation string, id string) (context.Context, *Span) {
+	ctx, span := StartSpan(ctx, "provider."+operation, SpanClient)
+	span.SetAttribute("till.provider", p.Name())
+	span.SetAttribute("till.provider_type", p.Type())
+	span.SetAttribute("till.object_id", id)
+	return ctx, span
+}
+
+// StartClientSpan starts a span for a request to another Till server, and
+// passes it on in the request's traceparent header.
+func StartClientSpan(ctx context.Context, req *http.Request) *Span {
+	ctx, span := StartSpan(ctx, "HTTP "+req.Method, SpanClient)
+	span.SetAttribute("http.method", req.Method)
+	span.SetAttribute("http.url", req.URL.String())
+	if c, ok := SpanContextFrom(ctx); ok {
+		req.Header.Set("traceparent", c.Traceparent())
+	}
+	return span
+}
+
+// EndResponse finishes a span started by StartClientSpan.
+func (s *Span) EndResponse(resp *http.Response, err error) {
+	if resp != nil {
+		s.SetAttribute("http.status_code", resp.StatusCode)
+		if resp.StatusCode >= 500 && err == nil {
+			err = fmt.Errorf("Till server responded with status %d.", resp.StatusCode)
+		}
+	}
+	s.End(err)
+}
+
+// routeName returns the path of a request with any identifiers replaced, to
+// name its span.
+func routeName(path string) string {
+	switch {
+	case strings.HasPrefix(path, "/api/v1/object/") && strings.HasSuffix(path, "/url"):
+		return "/api/v1/object/{id}/url"
+	case strings.HasPrefix(path, "/api/v1/object/"):
+		return "/api/v1/object/{id}"
+	case strings.HasPrefix(path, "/api/v1/server/"):
+		return "/api/v1/server/{id}"
+	}
+	return path
+}
+
+// TraceRequests starts a root span for every request, continuing the trace
+// given in its traceparent header if there is one. It must be wrapped by
+// LogRequests.
+func TraceRequests(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if remote, ok := ParseTraceparent(r.Header.Get("traceparent")); ok {
+			ctx = withSpanContext(ctx, remote)
+		}
+
+		ctx, span := StartSpan(ctx, r.Method+" "+routeName(r.URL.Path), SpanServer)
+		if span == nil {
+			handler.ServeHTTP(writer, r)
+			return
+		}
+
+		info := GetRequestInfo(ctx)
+		if info != nil {
+			info.Log = info.Log.With("trace_id", hex.EncodeToString(span.TraceID[:]))
+			span.SetAttribute("till.request_id", info.ID)
+		}
+		span.SetAttribute("http.method", r.Method)
+		span.SetAttribute("http.target", r.URL.Path)
+		span.SetAttribute("net.peer.addr", r.RemoteAddr)
+
+		recorder := &statusRecorder{ResponseWriter: writer}
+		defer func() {
+			status := recorder.status
+			if status == 0 {
+				status = 200
+			}
+			span.SetAttribute("http.status_code", status)
+			if info != nil && len(info.Provider) > 0 {
+				span.SetAttribute("till.provider", info.Provider)
+			}
+
+			var err error
+			if aborted := recover(); aborted != nil {
+				span.End(fmt.Errorf("Request aborted: %v", aborted))
+				panic(aborted)
+			} else if status >= 500 {
+				err = fmt.Errorf("Responded with status %d.", status)
+			}
+			span.End(err)
+		}()
+
+		handler.ServeHTTP(recorder, r.WithContext(ctx))
+	})
+}
+
+/*
+ *  Export.
+ */
+
+type spanExporter interface {
+	Export(batch []byte) error
+	Close()
+}
+
+type fileExporter struct {
+	file *os.File
+}
+
+func (e *fileExporter) Export(batch []byte) error {
+	_, err := e.file.Write(append(batch, '\n'))
+	return err
+}
+
+func (e *fileExporter) Close() {
+	e.file.Close()
+}
+
+type otlpExporter struct {
+	endpoint string
+	headers  map[string]string
+	client   *http.Client
+}
+
+func (e *otlpExporter) Export(batch []byte) error {
+	req, err := http.NewRequest("POST", e.endpoint, bytes.NewReader(batch))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range e.headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("OTLP collector responded with status %d.", resp.StatusCode)
+	}
+	return nil
+}
+
+func (e *otlpExporter) Close() {
+}
+
+type tracer struct {
+	config   *TracingConfig
+	exporter spanExporter
+
+	spans chan *Span
+	stop  chan bool
+	done  chan bool
+}
+
+var tracing struct {
+	sync.RWMutex
+	current *tracer
+}
+
+func currentTracer() *tracer {
+	tracing.RLock()
+	defer tracing.RUnlock()
+	return tracing.current
+}
+
+// ConfigureTracing replaces the running tracer (if any) with one for config,
+// which may be nil to turn tracing off. Spans already finished are exported
+// by the old tracer first.
+func ConfigureTracing(config *TracingConfig) {
+	var t *tracer
+	if config != nil {
+		var exporter spanExporter
+		switch config.Exporter {
+		case "otlp":
+			exporter = &otlpExporter{
+				endpoint: config.Endpoint,
+				headers:  config.Headers,
+				client:   &http.Client{Timeout: 10 * time.Second},
+			}
+		case "file":
+			file, err := os.OpenFile(config.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0664)
+			if err != nil {
+				Log.Errorf("Tracing disabled: could not open trace file: %v", err)
+			} else {
+				exporter = &fileExporter{file}
+			}
+		}
+
+		if exporter != nil {
+			t = &tracer{
+				config:   config,
+				exporter: exporter,
+				spans:    make(chan *Span, TraceQueueSize),
+				stop:     make(chan bool),
+				done:     make(chan bool),
+			}
+			go t.run()
+		}
+	}
+
+	tracing.Lock()
+	previous := tracing.current
+	tracing.current = t
+	tracing.Unlock()
+
+	if previous != nil {
+		previous.shutdown()
+	}
+}
+
+// ShutdownTracing exports any finished spans and turns tracing off.
+func ShutdownTracing() {
+	ConfigureTracing(nil)
+}
+
+// enqueue hands a finished span to the exporter. Spans are dropped rather than
+// holding up a request if the exporter can't keep up.
+func (t *tracer) enqueue(span *Span) {
+	select {
+	case t.spans <- span:
+	default:
+	}
+}
+
+func (t *tracer) run() {
+	ticker := time.NewTicker(TraceFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, TraceBatchSize)
+	for {
+		select {
+		case span := <-t.spans:
+			batch = append(batch, span)
+			if len(batch) >= TraceBatchSize {
+				t.export(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			t.export(batch)
+			batch = batch[:0]
+		case <-t.stop:
+			for drained := false; !drained; {
+				select {
+				case span := <-t.spans:
+					batch = append(batch, span)
+				default:
+					drained = true
+				}
+			}
+			t.export(batch)
+			t.exporter.Close()
+			close(t.done)
+			return
+		}
+	}
+}
+
+func (t *tracer) shutdown() {
+	close(t.stop)
+	<-t.done
+}
+
+func (t *tracer) export(batch []*Span) {
+	if len(batch) == 0 {
+		return
+	}
+
+	data, err := json.Marshal(t.encode(batch))
+	if err != nil {
+		Log.Errorf("Could not marshal trace spans: %v", err)
+		return
+	}
+	if err := t.exporter.Export(data); err != nil {
+		Log.Warnf("Could not export %d trace spans: %v", len(batch), err)
+	}
+}
+
+/*
+ *  OTLP/JSON encoding, as in ExportTraceServiceRequest. IDs are hex-encoded
+ *  and times are nanoseconds since the epoch, as strings.
+ */
+
+type otlpValue struct {
+	String *string  `json:"stringValue,omitempty"`
+	Int    *string  `json:"intValue,omitempty"`
+	Bool   *bool    `json:"boolValue,omitempty"`
+	Double *float64 `json:"doubleValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	Kind         SpanKind        `json:"kind"`
+	Start        string          `json:"startTimeUnixNano"`
+	End          string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+	Status       otlpStatus      `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func newOTLPAttribute(key string, value interface{}) otlpAttribute {
+	a := otlpAttribute{Key: key}
+	switch v := value.(type) {
+	case bool:
+		a.Value.Bool = &v
+	case int:
+		s := strconv.Itoa(v)
+		a.Value.Int = &s
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		a.Value.Int = &s
+	case float64:
+		a.Value.Double = &v
+	case string:
+		a.Value.String = &v
+	default:
+		s := fmt.Sprint(v)
+		a.Value.String = &s
+	}
+	return a
+}
+
+func (t *tracer) encode(batch []*Span) otlpTraces {
+	scope := otlpScopeSpans{Spans: make([]otlpSpan, 0, len(batch))}
+	scope.Scope.Name = "tilld"
+
+	for _, s := range batch {
+		s.mutex.Lock()
+		span := otlpSpan{
+			TraceID: hex.EncodeToString(s.TraceID[:]),
+			SpanID:  hex.EncodeToString(s.SpanID[:]),
+			Name:    s.name,
+			Kind:    s.kind,
+			Start:   strconv.FormatInt(s.start.UnixNano(), 10),
+			End:     strconv.FormatInt(s.end.UnixNano(), 10),
+			Status:  otlpStatus{Code: 1},
+		}
+		if s.parent != [8]byte{} {
+			span.ParentSpanID = hex.EncodeToString(s.parent[:])
+		}
+		for _, attribute := range s.attributes {
+			span.Attributes = append(span.Attributes, newOTLPAttribute(attribute.key, attribute.value))
+		}
+		if s.err != nil {
+			span.Status = otlpStatus{Code: 2, Message: s.err.Error()}
+		}
+		s.mutex.Unlock()
+
+		scope.Spans = append(scope.Spans, span)
+	}
+
+	resource := otlpResourceSpans{ScopeSpans: []otlpScopeSpans{scope}}
+	resource.Resource.Attributes = []otlpAttribute{
+		newOTLPAttribute("service.name", t.config.ServiceName),
+		newOTLPAttribute("service.instance.id", state.Identifier),
+	}
+	return otlpTraces{ResourceSpans: []otlpResourceSpans{resource}}
+}
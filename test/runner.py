@@ -3,10 +3,13 @@
 import os
 import sys
 import json
+import hashlib
+import hmac
 import time
 import base64
 import socket
 import random
+import zlib
 import requests
 import traceback
 import contextlib
@@ -121,6 +124,137 @@ def gen_multiple_config(port, cluster_port):
     }
 
 
+def gen_file_config(port, redis_port, **options):
+    #   A single file provider, with extra provider options.
+    provider = {
+        "type": "file",
+        "name": "test_file",
+        "whitelist": [".*"],
+
+        "path": "/tmp/till_%d" % port,
+        "maxsize": 1024 * 1024,
+        "maxitems": 10,
+    }
+    provider.update(options)
+    return {
+        "port": port,
+        "bind": "127.0.0.1",
+        "public_address": "127.0.0.1:%d" % port,
+        "default_lifespan": 3600,
+        "providers": [provider],
+    }
+
+
+def gen_encrypted_config(port, redis_port):
+    return gen_file_config(port, redis_port, encryption_keys=[
+        {"id": "test", "key": base64.b64encode(os.urandom(32))},
+    ])
+
+
+def gen_compressed_config(port, redis_port):
+    return gen_file_config(port, redis_port,
+                           compression="gzip", compression_min_size=16)
+
+
+def gen_promote_config(port, redis_port):
+    #   A slow file provider that promotes what it serves into a fast one.
+    config = gen_file_config(port, redis_port, name="test_slow",
+                             path="/tmp/till_%d_slow" % port,
+                             promote_to=["test_fast"])
+    config["providers"].append({
+        "type": "file",
+        "name": "test_fast",
+        "whitelist": [".*"],
+
+        "path": "/tmp/till_%d_fast" % port,
+        "maxsize": 1024 * 1024,
+        "maxitems": 10,
+    })
+    return config
+
+
+def gen_demote_config(port, redis_port):
+    #   A small file provider that demotes what it evicts into a larger one.
+    config = gen_promote_config(port, redis_port)
+    config["providers"].reverse()
+    config["providers"][0].update(maxitems=2, demote_to=["test_slow"])
+    del config["providers"][1]["promote_to"]
+    return config
+
+
+def gen_peer_config(port, peer_port):
+    #   A file provider, and another Till server that has this one as its peer.
+    config = gen_file_config(port, None)
+    config["providers"].append({
+        "type": "till",
+        "name": "test_peer",
+        "whitelist": [".*"],
+
+        "servers": ["127.0.0.1:%d" % peer_port],
+    })
+    return config
+
+
+def gen_lru_config(port, redis_port):
+    #   Room for two objects; adding the third evicts one.
+    return gen_file_config(port, redis_port, maxitems=3, eviction_policy="lru")
+
+
+def gen_content_addressed_config(port, redis_port):
+    return gen_file_config(port, redis_port, content_addressed=True)
+
+
+def gen_sequential_config(port, redis_port):
+    #   Two file providers, read one after the other.
+    config = gen_promote_config(port, redis_port)
+    del config["providers"][0]["promote_to"]
+    config["read_strategy"] = "sequential"
+    return config
+
+
+def gen_circuit_config(port, redis_port):
+    #   A file provider, and a peer that's never there whose circuit opens
+    #   after its first failure.
+    config = gen_file_config(port, redis_port)
+    config["providers"].append({
+        "type": "till",
+        "name": "test_dead",
+        "whitelist": [".*"],
+
+        "servers": ["127.0.0.1:%d" % randport()],
+        "circuit_breaker_failures": 1,
+        "circuit_breaker_backoff_in_milliseconds": 60000,
+    })
+    return config
+
+
+TEST_HMAC_KEY = {"id": "test", "secret": "test-secret",
+                 "scopes": ["read", "write"]}
+
+
+def gen_auth_config(port, redis_port):
+    config = gen_file_config(port, redis_port)
+    config["auth"] = {"hmac_keys": [TEST_HMAC_KEY]}
+    return config
+
+
+def sign_headers(method, path, headers, body=""):
+    #   Adds the headers and signature of a TILL-HMAC-SHA256 request.
+    headers = dict(headers)
+    headers["X-Till-Timestamp"] = str(int(time.time()))
+    headers["X-Till-Nonce"] = base64.b16encode(os.urandom(8)).lower()
+    headers.setdefault("X-Till-Content-SHA256",
+                       hashlib.sha256(body).hexdigest())
+    signed = [method, path] + sorted(
+        "%s:%s" % (k.lower(), v) for k, v in headers.items()
+        if k.lower().startswith("x-till-"))
+    signature = hmac.new(TEST_HMAC_KEY["secret"], "\n".join(signed),
+                         hashlib.sha256).hexdigest()
+    headers["Authorization"] = "TILL-HMAC-SHA256 %s:%s" % (
+        TEST_HMAC_KEY["id"], signature)
+    return headers
+
+
 MULTIPLE_PROVIDER_NAMES = [
     "test_redis",
     "test_file",
@@ -128,7 +262,9 @@ MULTIPLE_PROVIDER_NAMES = [
 ]
 
 
-def test(*funcs):
+def test(*funcs, **kwargs):
+    gen_config = kwargs.get('config', gen_single_config)
+
     good("================= STARTING TEST ===============")
     procs = []
     try:
@@ -139,7 +275,7 @@ def test(*funcs):
         env = {
             "TEST_UDP_PORT": str(udp_recv),
             "TILL_CONFIG":
-            json.dumps(gen_single_config(tilld_port, redis_port))
+            json.dumps(gen_config(tilld_port, redis_port))
         }
         env = dict(os.environ.items() + env.items())
         with redis_server(redis_port):
@@ -279,6 +415,52 @@ def cluster_test(*funcs, **kwargs):
             pass
 
 
+def peer_test(*funcs):
+    #   Two Till servers, each of which has the other as a till provider.
+    good("================= STARTING PEER TEST ===============")
+    procs = []
+    ports = [randport(), randport()]
+    try:
+        for i, tilld_port in enumerate(ports):
+            good("Launching tilld %d." % (i + 1))
+            udp_recv = randport()
+            env = {
+                "TEST_UDP_PORT": str(udp_recv),
+                "TILL_CONFIG":
+                json.dumps(gen_peer_config(tilld_port, ports[1 - i]))
+            }
+            env = dict(os.environ.items() + env.items())
+            procs += [Popen(['./bin/tilld'], env=env)]
+
+            unknown("Waiting for launch notification on UDP port %d." % udp_recv)
+            sock = socket.socket(socket.AF_INET, socket.SOCK_DGRAM)
+            sock.bind(("127.0.0.1", udp_recv))
+            sock.recvfrom(1)
+            sock.close()
+        good("Tilld launch detected. Running tests.")
+
+        for func in funcs:
+            a = time.time()
+            try:
+                success, code = func("localhost", str(ports[0]), str(ports[1]))
+            except Exception as e:
+                traceback.print_exc()
+                success, code = False, e
+            b = time.time()
+            if success is True:
+                good("[x] Test %s complete! (%2.2f msec)"
+                     % (func.__name__, (b - a) * 1000.0))
+            else:
+                bad("[ ] Test %s failed! (%2.2f msec, received %s)"
+                    % (func.__name__, (b - a) * 1000.0, code))
+    finally:
+        for proc in procs:
+            if proc and proc.poll() is None:
+                proc.kill()
+        for tilld_port in ports:
+            subprocess.call(["rm", "-rf", "/tmp/till_%d" % tilld_port])
+
+
 def post_no_headers(address, port):
     headers = {}
     obj_name = sys._getframe().f_code.co_name
@@ -335,6 +517,16 @@ def post_ok_metadata(address, port):
     return r.status_code == 400, r.status_code
 
 
+def post_reserved_metadata(address, port):
+    headers = {
+        "X-Till-Lifespan": "default",
+        "X-Till-Metadata": "till-encrypted:test:abc",
+    }
+    obj_name = sys._getframe().f_code.co_name
+    r = requests.post(make_obj_url(address, port, obj_name), headers=headers)
+    return r.status_code == 400 and "till-encrypted:" in r.json(), r.status_code
+
+
 def post_case_sensitive_lifespan(address, port):
     headers = {"x-till-lifespan": "123"}
     obj_name = sys._getframe().f_code.co_name
@@ -455,6 +647,233 @@ def post_get_scatter(address, port):
     return r.status_code == 200, r.status_code
 
 
+def post_delete_get(address, port):
+    #   Post a file to all caches, delete it, and make sure it's gone.
+    headers = {
+        "X-Till-Lifespan": "default",
+        "X-Till-Synchronized": "1",
+    }
+    obj_name = sys._getframe().f_code.co_name
+    url = make_obj_url(address, port, obj_name)
+    data = "\n".join(['test data'] * 100)
+    r = requests.post(url, data=data, headers=headers)
+    if r.status_code != 201:
+        assert r.json(), str(r.json())
+        return False, r.status_code
+
+    r = requests.delete(url, headers={"X-Till-Synchronized": "1"})
+    if r.status_code != 200:
+        return False, r.status_code
+
+    r = requests.get(url)
+    return r.status_code == 404, r.status_code
+
+
+def delete_missing(address, port):
+    headers = {"X-Till-Synchronized": "1"}
+    obj_name = sys._getframe().f_code.co_name
+    r = requests.delete(make_obj_url(address, port, obj_name), headers=headers)
+    return r.status_code == 200, r.status_code
+
+
+def delete_invalid_synchronized(address, port):
+    headers = {"X-Till-Synchronized": "2"}
+    obj_name = sys._getframe().f_code.co_name
+    r = requests.delete(make_obj_url(address, port, obj_name), headers=headers)
+    return r.status_code == 400, r.status_code
+
+
+def post_get_url(address, port):
+    #   Post a file to all caches, then fetch it again via its URL.
+    headers = {
+        "X-Till-Lifespan": "default",
+        "X-Till-Synchronized": "1",
+    }
+    obj_name = sys._getframe().f_code.co_name
+    url = make_obj_url(address, port, obj_name)
+    data = "\n".join(['test data'] * 100)
+    r = requests.post(url, data=data, headers=headers)
+    if r.status_code != 201:
+        assert r.json(), str(r.json())
+        return False, r.status_code
+
+    r = requests.get(url + "/url", headers={"X-Till-URL-Lifespan": "60"})
+    if r.status_code != 200:
+        return False, r.status_code
+
+    r = requests.get(r.text)
+    return r.status_code == 200 and r.text == data, r.status_code
+
+
+def get_url_missing(address, port):
+    obj_name = sys._getframe().f_code.co_name
+    r = requests.get(make_obj_url(address, port, obj_name) + "/url")
+    return r.status_code == 404, r.status_code
+
+
+def post_get_range(address, port):
+    #   Post a file to all caches, then get part of it back.
+    headers = {
+        "X-Till-Lifespan": "default",
+        "X-Till-Synchronized": "1",
+    }
+    obj_name = sys._getframe().f_code.co_name
+    url = make_obj_url(address, port, obj_name)
+    data = "\n".join(['test data'] * 100)
+    r = requests.post(url, data=data, headers=headers)
+    if r.status_code != 201:
+        assert r.json(), str(r.json())
+        return False, r.status_code
+
+    r = requests.get(url, headers={"Range": "bytes=10-19"})
+    if r.status_code != 206 or r.text != data[10:20]:
+        return False, r.status_code
+    return r.headers.get("Content-Range") == "bytes 10-19/%d" % len(data), \
+        r.status_code
+
+
+def post_get_not_modified(address, port):
+    #   Post a file to all caches, then get it again by ETag.
+    headers = {
+        "X-Till-Lifespan": "default",
+        "X-Till-Synchronized": "1",
+    }
+    obj_name = sys._getframe().f_code.co_name
+    url = make_obj_url(address, port, obj_name)
+    data = "\n".join(['test data'] * 100)
+    r = requests.post(url, data=data, headers=headers)
+    if r.status_code != 201:
+        assert r.json(), str(r.json())
+        return False, r.status_code
+
+    r = requests.get(url)
+    etag = r.headers.get("ETag")
+    if r.status_code != 200 or not etag:
+        return False, r.status_code
+
+    r = requests.get(url, headers={"If-None-Match": etag})
+    return r.status_code == 304, r.status_code
+
+
+def post_get_checksum(address, port):
+    #   Post a file to all caches, then check its checksum on GET and HEAD.
+    headers = {
+        "X-Till-Lifespan": "default",
+        "X-Till-Synchronized": "1",
+    }
+    obj_name = sys._getframe().f_code.co_name
+    url = make_obj_url(address, port, obj_name)
+    data = "\n".join(['test data'] * 100)
+    r = requests.post(url, data=data, headers=headers)
+    if r.status_code != 201:
+        assert r.json(), str(r.json())
+        return False, r.status_code
+
+    checksum = hashlib.sha256(data).hexdigest()
+    r = requests.get(url)
+    if r.status_code != 200 or r.text != data or \
+            r.headers.get("X-Till-Checksum") != checksum:
+        return False, r.status_code
+
+    r = requests.head(url)
+    return r.headers.get("X-Till-Checksum") == checksum, r.status_code
+
+
+def post_head(address, port):
+    #   Post a file to all caches, then check that it exists.
+    metadata = "some metadata"
+    headers = {
+        "X-Till-Lifespan": "default",
+        "X-Till-Synchronized": "1",
+        "X-Till-Metadata": metadata,
+    }
+    obj_name = sys._getframe().f_code.co_name
+    url = make_obj_url(address, port, obj_name)
+    data = "\n".join(['test data'] * 100)
+    r = requests.post(url, data=data, headers=headers)
+    if r.status_code != 201:
+        assert r.json(), str(r.json())
+        return False, r.status_code
+
+    r = requests.head(url)
+    if r.status_code != 200:
+        return False, r.status_code
+    return r.headers.get("X-Till-Metadata") == metadata and \
+        r.headers.get("Content-Length") == str(len(data)) and \
+        r.headers.get("X-Till-Provider") in SINGLE_PROVIDER_NAMES, \
+        r.status_code
+
+
+def head_missing(address, port):
+    obj_name = sys._getframe().f_code.co_name
+    r = requests.head(make_obj_url(address, port, obj_name))
+    return r.status_code == 404, r.status_code
+
+
+def post_put_get_encrypted(address, port):
+    #   Post an encrypted object, update its lifespan, then get it back.
+    headers = {
+        "X-Till-Lifespan": "default",
+        "X-Till-Synchronized": "1",
+        "X-Till-Metadata": "some metadata",
+    }
+    obj_name = sys._getframe().f_code.co_name
+    url = make_obj_url(address, port, obj_name)
+    data = "\n".join(['secret data'] * 100)
+    r = requests.post(url, data=data, headers=headers)
+    if r.status_code != 201:
+        assert r.json(), str(r.json())
+        return False, r.status_code
+
+    r = requests.put(url, headers={
+        "X-Till-Lifespan": "7200",
+        "X-Till-Synchronized": "1",
+    })
+    if r.status_code != 201:
+        return False, r.status_code
+
+    r = requests.get(url)
+    return r.status_code == 200 and r.text == data and \
+        r.headers.get("X-Till-Metadata") == "some metadata", r.status_code
+
+
+def post_put_get_compressed(address, port):
+    #   Post a compressed object, update its lifespan, then get it back
+    #   both decompressed and as stored.
+    headers = {
+        "X-Till-Lifespan": "default",
+        "X-Till-Synchronized": "1",
+    }
+    obj_name = sys._getframe().f_code.co_name
+    url = make_obj_url(address, port, obj_name)
+    data = "\n".join(['compressible data'] * 100)
+    r = requests.post(url, data=data, headers=headers)
+    if r.status_code != 201:
+        assert r.json(), str(r.json())
+        return False, r.status_code
+
+    r = requests.put(url, headers={
+        "X-Till-Lifespan": "7200",
+        "X-Till-Synchronized": "1",
+    })
+    if r.status_code != 201:
+        return False, r.status_code
+
+    checksum = hashlib.sha256(data).hexdigest()
+    r = requests.get(url)
+    if r.status_code != 200 or r.text != data or \
+            r.headers.get("Content-Encoding") is not None or \
+            r.headers.get("X-Till-Checksum") != checksum:
+        return False, r.status_code
+    etag = r.headers.get("ETag")
+
+    r = requests.get(url, headers={"Accept-Encoding": "gzip"})
+    if r.status_code != 200 or r.headers.get("Content-Encoding") != "gzip":
+        return False, r.status_code
+    stored = zlib.decompress(r.content, 16 + zlib.MAX_WBITS)
+    return stored == data and r.headers.get("ETag") != etag, r.status_code
+
+
 def post_get_cluster(address, port1, port2):
     #   Post a file to the slave, try to get it from the master, and pass.
     metadata = "\n".join(['meta data'] * 100)
@@ -479,6 +898,304 @@ def post_get_cluster(address, port1, port2):
     return r.status_code == 200 and r.text == data, r.status_code
 
 
+def post_get_promoted(address, port):
+    #   A GET from the slow provider copies the object into the fast one,
+    #   along with its remaining lifespan.
+    headers = {
+        "X-Till-Lifespan": "100",
+        "X-Till-Synchronized": "1",
+        "X-Till-Providers": "test_slow",
+    }
+    obj_name = sys._getframe().f_code.co_name
+    url = make_obj_url(address, port, obj_name)
+    data = "\n".join(['test data'] * 100)
+    r = requests.post(url, data=data, headers=headers)
+    if r.status_code != 201:
+        return False, r.status_code
+
+    r = requests.get(url)
+    if r.status_code != 200 or r.text != data:
+        return False, r.status_code
+    expires = int(r.headers.get("X-Till-Expires"))
+
+    for attempt in range(20):
+        time.sleep(0.05)
+        r = requests.get(url, headers={"X-Till-Providers": "test_fast"})
+        if r.status_code == 200:
+            break
+    if r.status_code != 200 or r.text != data:
+        return False, r.status_code
+    return int(r.headers.get("X-Till-Expires")) == expires, r.status_code
+
+
+def post_get_demoted(address, port):
+    #   Objects evicted from the fast provider are moved to the slow one.
+    headers = {
+        "X-Till-Lifespan": "100",
+        "X-Till-Synchronized": "1",
+        "X-Till-Providers": "test_fast",
+    }
+    obj_name = sys._getframe().f_code.co_name
+    data = "\n".join(['test data'] * 100)
+    for i in range(3):
+        url = make_obj_url(address, port, "%s_%d" % (obj_name, i))
+        r = requests.post(url, data=data, headers=headers)
+        if r.status_code != 201:
+            return False, r.status_code
+
+    url = make_obj_url(address, port, "%s_0" % obj_name)
+    for attempt in range(20):
+        r = requests.get(url, headers={"X-Till-Providers": "test_fast"})
+        if r.status_code == 404:
+            break
+        time.sleep(0.05)
+    if r.status_code != 404:
+        return False, r.status_code
+
+    r = requests.get(url, headers={"X-Till-Providers": "test_slow"})
+    return r.status_code == 200 and r.text == data, r.status_code
+
+
+def post_delete_peers(address, port1, port2):
+    #   Delete from one of two servers that are each other's peers. The
+    #   delete reaches the other server once, and isn't passed back.
+    headers = {
+        "X-Till-Lifespan": "default",
+        "X-Till-Synchronized": "1",
+    }
+    obj_name = sys._getframe().f_code.co_name
+    url1 = make_obj_url(address, port1, obj_name)
+    url2 = make_obj_url(address, port2, obj_name)
+    data = "\n".join(['test data'] * 100)
+    r = requests.post(url1, data=data, headers=headers)
+    if r.status_code != 201:
+        return False, r.status_code
+    r = requests.post(url2, data=data, headers=headers)
+    if r.status_code != 201:
+        return False, r.status_code
+
+    started = time.time()
+    r = requests.delete(url1, headers={"X-Till-Synchronized": "1"})
+    if r.status_code != 200 or time.time() - started > 1:
+        return False, r.status_code
+
+    r = requests.get(url2, headers={"X-Till-Providers": "test_file"})
+    return r.status_code == 404, r.status_code
+
+
+def metric_value(address, port, sample):
+    r = requests.get("http://%s:%s/metrics" % (address, port))
+    for line in r.text.splitlines():
+        if line.startswith(sample + " "):
+            return float(line.split(" ")[1])
+    return None
+
+
+def post_delete_metrics(address, port):
+    #   The file provider's object and byte gauges follow posts and deletes.
+    sample = 'till_provider_%s{provider="test_file"}'
+    objects = metric_value(address, port, sample % "objects")
+    size = metric_value(address, port, sample % "bytes")
+    if objects is None or size is None:
+        return False, "missing gauges"
+
+    headers = {
+        "X-Till-Lifespan": "default",
+        "X-Till-Synchronized": "1",
+    }
+    obj_name = sys._getframe().f_code.co_name
+    url = make_obj_url(address, port, obj_name)
+    r = requests.post(url, data="x" * 1000, headers=headers)
+    if r.status_code != 201:
+        return False, r.status_code
+    if metric_value(address, port, sample % "objects") != objects + 1 or \
+            metric_value(address, port, sample % "bytes") != size + 1000:
+        return False, "gauges not increased"
+
+    r = requests.delete(url, headers={"X-Till-Synchronized": "1"})
+    if r.status_code != 200:
+        return False, r.status_code
+    return metric_value(address, port, sample % "objects") == objects and \
+        metric_value(address, port, sample % "bytes") == size, \
+        "gauges not decreased"
+
+
+def post_get_evicted_lru(address, port):
+    #   Reading an object keeps it when a full file provider evicts.
+    headers = {
+        "X-Till-Lifespan": "default",
+        "X-Till-Synchronized": "1",
+    }
+    obj_name = sys._getframe().f_code.co_name
+    urls = [make_obj_url(address, port, obj_name + str(i)) for i in range(3)]
+    for url in urls[0:2]:
+        r = requests.post(url, data="test data", headers=headers)
+        if r.status_code != 201:
+            return False, r.status_code
+        time.sleep(1.1)
+    r = requests.get(urls[0])
+    if r.status_code != 200:
+        return False, r.status_code
+
+    r = requests.post(urls[2], data="test data", headers=headers)
+    if r.status_code != 201:
+        return False, r.status_code
+    for _ in range(20):
+        if requests.get(urls[1]).status_code == 404:
+            break
+        time.sleep(0.1)
+    codes = [requests.get(url).status_code for url in urls]
+    return codes == [200, 404, 200], codes
+
+
+def post_sharded(address, port):
+    #   Objects are stored two directories deep, by the MD5 of their key.
+    headers = {
+        "X-Till-Lifespan": "default",
+        "X-Till-Synchronized": "1",
+    }
+    obj_name = sys._getframe().f_code.co_name
+    r = requests.post(make_obj_url(address, port, obj_name),
+                      data="test data", headers=headers)
+    if r.status_code != 201:
+        return False, r.status_code
+    shard = hashlib.md5(obj_name).hexdigest()
+    path = "/tmp/till_%s/files/%s/%s/%s" % (port, shard[0:2], shard[2:4],
+                                             obj_name)
+    return os.path.exists(path), path
+
+
+def post_content_addressed(address, port):
+    headers = {
+        "X-Till-Lifespan": "default",
+        "X-Till-Synchronized": "1",
+    }
+    obj_name = sys._getframe().f_code.co_name
+    data = "\n".join(['test data'] * 100)
+    r = requests.post(make_obj_url(address, port, obj_name),
+                      data=data, headers=headers)
+    if r.status_code != 400:
+        return False, r.status_code
+
+    digest = hashlib.sha256(data).hexdigest()
+    r = requests.post(make_obj_url(address, port, digest),
+                      data=data + "x", headers=headers)
+    if r.status_code != 400:
+        return False, r.status_code
+
+    r = requests.post(make_obj_url(address, port, digest),
+                      data=data, headers=headers)
+    if r.status_code != 201:
+        return False, r.status_code
+
+    r = requests.get(make_obj_url(address, port, digest))
+    return r.status_code == 200 and r.content == data, r.status_code
+
+
+def get_stats_redacted(address, port):
+    #   Stats describe each provider without giving away its keys.
+    r = requests.get("http://%s:%s/api/v1/stats" % (address, port))
+    if r.status_code != 200:
+        return False, r.status_code
+    stats = r.json()
+    provider = stats["providers"].get("test_file")
+    if provider is None or provider["type"] != "file":
+        return False, stats
+    return "encryption_keys" not in r.text and "key" not in provider, r.text
+
+
+def get_request_id(address, port):
+    #   Each response carries the request's ID, or the one it was sent with.
+    url = make_obj_url(address, port, sys._getframe().f_code.co_name)
+    r = requests.get(url)
+    if not r.headers.get("X-Till-Request-ID"):
+        return False, r.headers
+    r = requests.get(url, headers={"X-Till-Request-ID": "test-request-1"})
+    return r.headers.get("X-Till-Request-ID") == "test-request-1", r.headers
+
+
+def post_get_sequential(address, port):
+    #   An object held only by the second provider is found after the first
+    #   misses.
+    headers = {
+        "X-Till-Lifespan": "default",
+        "X-Till-Synchronized": "1",
+        "X-Till-Providers": "test_fast",
+    }
+    obj_name = sys._getframe().f_code.co_name
+    url = make_obj_url(address, port, obj_name)
+    data = "\n".join(['test data'] * 100)
+    r = requests.post(url, data=data, headers=headers)
+    if r.status_code != 201:
+        return False, r.status_code
+
+    r = requests.get(url)
+    return r.status_code == 200 and r.content == data, r.status_code
+
+
+def delete_circuit_open(address, port):
+    #   Once a provider fails, its circuit opens and it's skipped.
+    url = make_obj_url(address, port, sys._getframe().f_code.co_name)
+    stats_url = "http://%s:%s/api/v1/stats" % (address, port)
+    r = requests.delete(url, headers={"X-Till-Synchronized": "1"})
+    if r.status_code != 202:
+        return False, r.status_code
+
+    circuit = requests.get(stats_url).json()["providers"]["test_dead"]["circuit"]
+    if circuit["state"] != "open" or circuit["opened"] != 1:
+        return False, circuit
+
+    r = requests.delete(url, headers={"X-Till-Synchronized": "1"})
+    if r.status_code != 200:
+        return False, r.status_code
+    circuit = requests.get(stats_url).json()["providers"]["test_dead"]["circuit"]
+    return circuit["consecutive_failures"] == 1, circuit
+
+
+def post_unsigned(address, port):
+    obj_name = sys._getframe().f_code.co_name
+    r = requests.post(make_obj_url(address, port, obj_name),
+                      headers={"X-Till-Lifespan": "default"}, data="foo")
+    return r.status_code == 401, r.status_code
+
+
+def post_signed_replayed(address, port):
+    obj_name = sys._getframe().f_code.co_name
+    url = make_obj_url(address, port, obj_name)
+    headers = sign_headers("POST", "/api/v1/object/" + obj_name,
+                           {"X-Till-Lifespan": "default"}, "foo")
+    r = requests.post(url, headers=headers, data="foo")
+    if r.status_code not in [201, 202]:
+        return False, r.status_code
+
+    r = requests.post(url, headers=headers, data="foo")
+    return r.status_code == 401, r.status_code
+
+
+def post_signed_tampered(address, port):
+    obj_name = sys._getframe().f_code.co_name
+    headers = sign_headers("POST", "/api/v1/object/" + obj_name,
+                           {"X-Till-Lifespan": "default"}, "foo")
+    headers["X-Till-Lifespan"] = "60"
+    r = requests.post(make_obj_url(address, port, obj_name),
+                      headers=headers, data="foo")
+    return r.status_code == 401, r.status_code
+
+
+def post_signed_wrong_body(address, port):
+    obj_name = sys._getframe().f_code.co_name
+    headers = sign_headers("POST", "/api/v1/object/" + obj_name,
+                           {"X-Till-Lifespan": "default"}, "foo")
+    url = make_obj_url(address, port, obj_name)
+    r = requests.post(url, headers=headers, data="bar")
+    if r.status_code != 400:
+        return False, r.status_code
+
+    headers = sign_headers("GET", "/api/v1/object/" + obj_name, {})
+    r = requests.get(url, headers=headers)
+    return r.status_code == 404, r.status_code
+
+
 if __name__ == "__main__":
     unknown("Launching test cases...")
     unknown("Press Ctrl-C to stop the tests.")
@@ -497,6 +1214,72 @@ if __name__ == "__main__":
         post_get_wrong,
         post_get_correct,
         post_get_scatter,
+        post_delete_get,
+        delete_missing,
+        delete_invalid_synchronized,
+        post_get_url,
+        get_url_missing,
+        post_get_range,
+        post_get_not_modified,
+        post_get_checksum,
+        post_head,
+        head_missing,
+    )
+    test(
+        post_no_headers,
+        post_put_get_encrypted,
+        post_reserved_metadata,
+        get_stats_redacted,
+        config=gen_encrypted_config,
+    )
+    test(
+        post_no_headers,
+        post_put_get_compressed,
+        config=gen_compressed_config,
+    )
+    test(
+        post_no_headers,
+        post_delete_metrics,
+        post_sharded,
+        get_request_id,
+        config=gen_file_config,
+    )
+    test(
+        post_no_headers,
+        post_get_evicted_lru,
+        config=gen_lru_config,
+    )
+    test(
+        post_no_headers,
+        post_content_addressed,
+        config=gen_content_addressed_config,
+    )
+    test(
+        post_no_headers,
+        post_get_sequential,
+        config=gen_sequential_config,
+    )
+    test(
+        post_no_headers,
+        delete_circuit_open,
+        config=gen_circuit_config,
+    )
+    test(
+        post_unsigned,
+        post_signed_replayed,
+        post_signed_tampered,
+        post_signed_wrong_body,
+        config=gen_auth_config,
+    )
+    test(
+        post_no_headers,
+        post_get_promoted,
+        config=gen_promote_config,
+    )
+    test(
+        post_no_headers,
+        post_get_demoted,
+        config=gen_demote_config,
     )
     cluster_test_master(
         post_no_headers,
@@ -529,3 +1312,6 @@ if __name__ == "__main__":
     cluster_test_both(
         post_get_cluster,
     )
+    peer_test(
+        post_delete_peers,
+    )